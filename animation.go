@@ -0,0 +1,146 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/color/palette"
+    "image/draw"
+    "image/gif"
+)
+
+func decodeAnimation(body []byte) (*gif.GIF, error) {
+    err := checkImageLimits(body)
+    if err != nil {
+        return nil, err
+    }
+    return gif.DecodeAll(bytes.NewReader(body))
+}
+
+// Renders the frames of g the way a browser would show them, applying each
+// frame's disposal method before drawing the next one, and hands them to fn
+// one at a time until it returns false. Only a few screen sized buffers are
+// used however many frames there are, so fn must not keep the frame it is
+// given, but it may modify it.
+func compositeGifFrames(g *gif.GIF, fn func(i int, frame *image.NRGBA) bool) {
+    bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+    if bounds.Empty() {
+        bounds = g.Image[0].Bounds()
+    }
+    canvas := image.NewNRGBA(bounds)
+    snapshot := image.NewNRGBA(bounds)
+    var previous *image.NRGBA
+
+    for i, frame := range g.Image {
+        disposal := byte(0)
+        if i < len(g.Disposal) {
+            disposal = g.Disposal[i]
+        }
+        if disposal == gif.DisposalPrevious {
+            if previous == nil {
+                previous = image.NewNRGBA(bounds)
+            }
+            copy(previous.Pix, canvas.Pix)
+        }
+
+        draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+        copy(snapshot.Pix, canvas.Pix)
+        if !fn(i, snapshot) {
+            return
+        }
+
+        switch disposal {
+        case gif.DisposalBackground:
+            draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+        case gif.DisposalPrevious:
+            copy(canvas.Pix, previous.Pix)
+        }
+    }
+}
+
+// Transforms an animated GIF frame by frame, keeping delays, disposal
+// methods and loop count. With t.Frame set, or when converting to another
+// format, a single frame is extracted as a static image instead.
+func applyGifTransform(source ResponseData, t Transform, pipeline *pixelPipeline) (ResponseData, error) {
+    g, err := decodeAnimation(source.Body)
+    if err != nil {
+        return source, fmt.Errorf("cannot decode source image: %v", err)
+    }
+
+    if t.Frame > 0 || len(g.Image) == 1 || (t.Format != "" && t.Format != "gif") {
+        index := 0
+        if t.Frame > 0 {
+            index = t.Frame - 1
+        }
+        if index >= len(g.Image) {
+            return source, fmt.Errorf("frame %v requested but the image has %v", t.Frame, len(g.Image))
+        }
+        format := t.Format
+        if format == "" {
+            format = "gif"
+            if t.Frame > 0 {
+                format = "png" // posters keep full color
+            }
+        }
+        var poster image.Image
+        compositeGifFrames(g, func(i int, frame *image.NRGBA) bool {
+            if i < index {
+                return true
+            }
+            poster = pipeline.apply(frame)
+            return false
+        })
+        return encodeTransformed(source, poster, format, t)
+    }
+
+    if t.MaxBytes > 0 {
+        return source, errors.New(maxBytesFormatError)
+    }
+    result := &gif.GIF{
+        Delay: g.Delay,
+        Disposal: g.Disposal,
+        LoopCount: g.LoopCount,
+    }
+    compositeGifFrames(g, func(i int, frame *image.NRGBA) bool {
+        result.Image = append(result.Image, toPaletted(pipeline.apply(frame), framePalette(g.Image[i], t)))
+        return true
+    })
+
+    var buf bytes.Buffer
+    err = gif.EncodeAll(&buf, result)
+    if err != nil {
+        return source, fmt.Errorf("cannot encode gif image: %v", err)
+    }
+    return ResponseData{
+        ContentType: "image/gif",
+        Body: buf.Bytes(),
+        StatusCode: source.StatusCode,
+    }, nil
+}
+
+// Resizing only blends between existing colors, so the original palette
+// still fits. Color filters move everything, so they get a generic one.
+func framePalette(frame *image.Paletted, t Transform) color.Palette {
+    p := frame.Palette
+    if t.Brightness != 0 || t.Contrast != 0 || t.Saturation != 0 || t.Grayscale || t.Sepia {
+        p = palette.WebSafe
+    }
+    for _, c := range p {
+        if _, _, _, a := c.RGBA(); a == 0 {
+            return p
+        }
+    }
+    if len(p) < 256 {
+        p = append(append(color.Palette{}, p...), color.Transparent)
+    }
+    return p
+}
+
+func toPaletted(img image.Image, p color.Palette) *image.Paletted {
+    b := img.Bounds()
+    dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), p)
+    draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+    return dst
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "strings"
+)
+
+// Parses RGB, RRGGBB or RRGGBBAA hex notation, with or without a leading #.
+func parseHexColor(s string) (color.NRGBA, error) {
+    s = strings.TrimPrefix(s, "#")
+    if len(s) == 3 {
+        s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+    }
+    if len(s) == 6 {
+        s += "ff"
+    }
+    b, err := hex.DecodeString(s)
+    if err != nil || len(b) != 4 {
+        return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+    }
+    return color.NRGBA{b[0], b[1], b[2], b[3]}, nil
+}
+
+// Centers img on a transparent w x h canvas.
+func padImage(img image.Image, w, h int) image.Image {
+    b := img.Bounds()
+    if w == 0 || h == 0 || (b.Dx() == w && b.Dy() == h) {
+        return img
+    }
+    dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+    at := image.Pt((w-b.Dx())/2, (h-b.Dy())/2)
+    draw.Draw(dst, b.Sub(b.Min).Add(at), img, b.Min, draw.Src)
+    return dst
+}
+
+// Composites img onto a solid background, removing its transparency.
+func flattenImage(img image.Image, bg color.Color) image.Image {
+    b := img.Bounds()
+    dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+    draw.Draw(dst, dst.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+    draw.Draw(dst, dst.Rect, img, b.Min, draw.Over)
+    return dst
+}
+
+func isOpaque(img image.Image) bool {
+    if o, ok := img.(interface {
+        Opaque() bool
+    }); ok {
+        return o.Opaque()
+    }
+    return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "image"
+    "math"
+    "strings"
+)
+
+// Encoder for https://blurha.sh, a compact string representation of a
+// blurred image that clients can decode into a placeholder.
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+    var sb strings.Builder
+    for i := 1; i <= length; i++ {
+        digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+        sb.WriteByte(base83Chars[digit])
+    }
+    return sb.String()
+}
+
+func sRGBToLinear(v uint8) float64 {
+    f := float64(v) / 255
+    if f <= 0.04045 {
+        return f / 12.92
+    }
+    return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+    v = math.Max(0, math.Min(1, v))
+    if v <= 0.0031308 {
+        return int(v*12.92*255 + 0.5)
+    }
+    return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+    return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// Encodes img with xComponents x yComponents DCT components (1-9 each).
+func encodeBlurHash(img *image.NRGBA, xComponents, yComponents int) string {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    factors := make([][3]float64, 0, xComponents*yComponents)
+    for j := 0; j < yComponents; j++ {
+        for i := 0; i < xComponents; i++ {
+            var r, g, b float64
+            for y := 0; y < h; y++ {
+                for x := 0; x < w; x++ {
+                    basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+                        math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+                    p := img.Pix[img.PixOffset(x, y):]
+                    r += basis * sRGBToLinear(p[0])
+                    g += basis * sRGBToLinear(p[1])
+                    b += basis * sRGBToLinear(p[2])
+                }
+            }
+            scale := 2.0 / float64(w*h)
+            if i == 0 && j == 0 {
+                scale = 1.0 / float64(w*h)
+            }
+            factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+        }
+    }
+
+    var sb strings.Builder
+    sb.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+    dc, ac := factors[0], factors[1:]
+    maximum := 1.0
+    if len(ac) > 0 {
+        actualMax := 0.0
+        for _, f := range ac {
+            actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+        }
+        quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+        maximum = float64(quantised+1) / 166
+        sb.WriteString(encodeBase83(quantised, 1))
+    } else {
+        sb.WriteString(encodeBase83(0, 1))
+    }
+
+    sb.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+    quantise := func(v float64) int {
+        return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+    }
+    for _, f := range ac {
+        sb.WriteString(encodeBase83(quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2))
+    }
+    return sb.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "strings"
+)
+
+// Rewrites u in place into its canonical form, so equivalent URLs share a
+// cache key and an origin fetch: the path is cleaned (duplicate slashes
+// and "." segments), and lowercased with CANONICAL_LOWERCASE, the query is
+// sorted and params matching IGNORED_PARAMS are dropped. Paths with ".."
+// segments are refused instead of resolved, nothing outside the origin
+// root should be reachable.
+func canonicalize(u *url.URL) error {
+    if strings.ContainsAny(u.Path, "\\\x00") {
+        return errors.New("invalid characters in path")
+    }
+    for _, segment := range strings.Split(u.Path, "/") {
+        if segment == ".." {
+            return errors.New("path traversal is not allowed")
+        }
+    }
+
+    clean := path.Clean("/" + u.Path)
+    if lowercasePaths {
+        clean = strings.ToLower(clean)
+    }
+    u.Path, u.RawPath = clean, ""
+
+    query := u.Query()
+    for name := range query {
+        if isIgnoredParam(name) {
+            query.Del(name)
+        }
+    }
+    u.RawQuery = query.Encode()
+    u.ForceQuery = false
+    u.Fragment, u.RawFragment = "", ""
+    return nil
+}
+
+// Tracking params are ignored unless IGNORED_PARAMS says otherwise, cache
+// busters differ between sites and have to be listed there.
+func ignoredParamsSetting() []string {
+    if os.Getenv("IGNORED_PARAMS") == "" {
+        return []string{"utm_*", "fbclid", "gclid"}
+    }
+    return listSetting("IGNORED_PARAMS")
+}
+
+// Entries of IGNORED_PARAMS match exactly, or by prefix if they end in *.
+func isIgnoredParam(name string) bool {
+    for _, ignored := range ignoredParams {
+        if strings.HasSuffix(ignored, "*") {
+            if strings.HasPrefix(name, strings.TrimSuffix(ignored, "*")) {
+                return true
+            }
+        } else if name == ignored {
+            return true
+        }
+    }
+    return false
+}
+
+// Parses a path with optional query given in a request or the config, like
+// a sprite tile, into its canonical URL.
+func canonicalUrl(rawUrl string) (*url.URL, error) {
+    u, err := url.Parse(rawUrl)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "" || u.Host != "" {
+        return nil, errors.New("only paths are allowed")
+    }
+    return u, canonicalize(u)
+}
+
+type receivedUrlKey struct{}
+
+// Canonicalizes the request URL for everything that follows. The URL as
+// received stays available through receivedUrl.
+func withCanonicalUrl(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        received := *r.URL
+        if err := canonicalize(r.URL); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        handler(w, r.WithContext(context.WithValue(r.Context(), receivedUrlKey{}, &received)))
+    }
+}
+
+// The URL of r as the client sent it. Signatures are verified against it,
+// signers cannot be expected to know about CANONICAL_LOWERCASE or
+// IGNORED_PARAMS.
+func receivedUrl(r *http.Request) *url.URL {
+    if u, ok := r.Context().Value(receivedUrlKey{}).(*url.URL); ok {
+        return u
+    }
+    return r.URL
+}
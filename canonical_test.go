@@ -0,0 +1,93 @@
+package main
+
+import (
+    "net/url"
+    "testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+    tests := []struct {
+        url string
+        lowercase bool
+        want string
+    }{
+        {"/a.jpg", false, "/a.jpg"},
+        {"//a//b/./c.jpg", false, "/a/b/c.jpg"},
+        {"/a/b/", false, "/a/b"},
+        {"/A/B.JPG", false, "/A/B.JPG"},
+        {"/A/B.JPG", true, "/a/b.jpg"},
+        {"/a.jpg?w=1&h=2", false, "/a.jpg?h=2&w=1"},
+        {"/a.jpg?", false, "/a.jpg"},
+        {"/a.jpg?utm_source=x&w=1&fbclid=y&gclid=z", false, "/a.jpg?w=1"},
+        {"/a.jpg?UTM_source=x", false, "/a.jpg?UTM_source=x"},
+        {"/a%20b.jpg?w=1", false, "/a%20b.jpg?w=1"},
+    }
+    defer func(previous bool) { lowercasePaths = previous }(lowercasePaths)
+    for _, test := range tests {
+        lowercasePaths = test.lowercase
+        u, err := url.ParseRequestURI(test.url)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := canonicalize(u); err != nil {
+            t.Errorf("canonicalize(%v): unexpected error %v", test.url, err)
+            continue
+        }
+        if got := u.String(); got != test.want {
+            t.Errorf("canonicalize(%v) = %v, want %v", test.url, got, test.want)
+        }
+    }
+}
+
+func TestCanonicalizeRefuses(t *testing.T) {
+    for _, rawUrl := range []string{
+        "/../etc/passwd",
+        "/a/../../b.jpg",
+        "/a/..",
+        "/a/%2e%2e/b.jpg",
+        "/a\\b.jpg",
+        "/a%5Cb.jpg",
+        "/a%00.jpg",
+    } {
+        u, err := url.ParseRequestURI(rawUrl)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := canonicalize(u); err == nil {
+            t.Errorf("canonicalize(%v) = %v, expected an error", rawUrl, u)
+        }
+    }
+}
+
+func TestIsIgnoredParam(t *testing.T) {
+    defer func(previous []string) { ignoredParams = previous }(ignoredParams)
+    ignoredParams = []string{"utm_*", "cb"}
+    tests := []struct {
+        name string
+        ignored bool
+    }{
+        {"utm_source", true},
+        {"utm_", true},
+        {"cb", true},
+        {"cbx", false},
+        {"w", false},
+        {"utm", false},
+    }
+    for _, test := range tests {
+        if ignored := isIgnoredParam(test.name); ignored != test.ignored {
+            t.Errorf("isIgnoredParam(%v) = %v, want %v", test.name, ignored, test.ignored)
+        }
+    }
+}
+
+func TestCanonicalUrl(t *testing.T) {
+    for _, rawUrl := range []string{"https://evil.example/a.jpg", "//evil.example/a.jpg"} {
+        if _, err := canonicalUrl(rawUrl); err == nil {
+            t.Errorf("canonicalUrl(%v): expected an error", rawUrl)
+        }
+    }
+    u, err := canonicalUrl("/a//b.jpg?utm_source=x")
+    if err != nil || u.String() != "/a/b.jpg" {
+        t.Errorf("canonicalUrl = %v, %v", u, err)
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+const (
+    maxDPR = 4
+    // Widths from client hints are rounded up to multiples of this.
+    hintWidthStep = 100
+)
+
+// Device pixel ratios variants are rendered for, any other is snapped to
+// the nearest of them. Together with the width steps this bounds how many
+// variants headers and dpr can make of one URL.
+var dprSteps = []float64{1, 1.5, 2, 3, 4}
+
+// Client hints browsers are asked to send with image requests.
+var acceptClientHints = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"}
+
+// Resolves the device pixel ratio of a transform into physical Width and
+// Height, filling in what the browser sent as client hints where the URL
+// leaves it open. With onlyPresets the width hints are ignored, presets
+// choose the size. Originals are never touched. Returns the hints that were
+// consulted, which the response has to Vary on.
+func applyClientHints(t Transform, header http.Header, onlyPresets bool) (Transform, []string) {
+    if t.isEmpty() {
+        return t, nil
+    }
+    var used []string
+    hint := func(name string) float64 {
+        used = append(used, name)
+        value, err := strconv.ParseFloat(strings.TrimSpace(header.Get(name)), 64)
+        if err != nil || value <= 0 {
+            return 0
+        }
+        return value
+    }
+
+    dpr := t.DPR
+    if dpr == 0 {
+        dpr = hint("Sec-CH-DPR")
+    }
+    dpr = snapDPR(dpr)
+
+    scale := func(v float64) int {
+        return int(minFloat(v, maxDimension) + 0.5)
+    }
+    switch {
+    case t.Width > 0 || t.Height > 0:
+        t.Width, t.Height = scale(float64(t.Width)*dpr), scale(float64(t.Height)*dpr)
+    case onlyPresets:
+        // Keeps the size of the preset.
+    default:
+        // Sec-CH-Width is already in physical pixels.
+        if width := hint("Sec-CH-Width"); width > 0 {
+            t.Width = snapHintWidth(width)
+        } else if viewport := hint("Sec-CH-Viewport-Width"); viewport > 0 {
+            t.Width = snapHintWidth(viewport * dpr)
+        }
+    }
+    t.DPR = 0
+    return t, used
+}
+
+// The step of dprSteps nearest to dpr, 1 if it is unknown.
+func snapDPR(dpr float64) float64 {
+    snapped := dprSteps[0]
+    for _, step := range dprSteps {
+        if math.Abs(step-dpr) < math.Abs(snapped-dpr) {
+            snapped = step
+        }
+    }
+    return snapped
+}
+
+func snapHintWidth(width float64) int {
+    steps := math.Ceil(minFloat(width, maxDimension) / hintWidthStep)
+    return int(minFloat(steps*hintWidthStep, maxDimension))
+}
+
+func addClientHintHeaders(w http.ResponseWriter, used []string) {
+    w.Header().Set("Accept-CH", strings.Join(acceptClientHints, ", "))
+    if len(used) > 0 {
+        w.Header().Add("Vary", strings.Join(used, ", "))
+    }
+}
+
+func minFloat(a, b float64) float64 {
+    if a < b {
+        return a
+    }
+    return b
+}
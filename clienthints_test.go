@@ -0,0 +1,39 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestApplyClientHints(t *testing.T) {
+    tests := []struct {
+        name string
+        t Transform
+        headers map[string]string
+        onlyPresets bool
+        width, height int
+    }{
+        {"no hints", Transform{Width: 100}, nil, false, 100, 0},
+        {"dpr param", Transform{Width: 100, DPR: 2}, nil, false, 200, 0},
+        {"dpr param snapped", Transform{Width: 100, DPR: 1.37}, nil, false, 150, 0},
+        {"dpr hint snapped", Transform{Width: 100, Height: 50}, map[string]string{"Sec-CH-DPR": "2.6"}, false, 300, 150},
+        {"dpr hint below 1", Transform{Width: 100}, map[string]string{"Sec-CH-DPR": "0.3"}, false, 100, 0},
+        {"invalid dpr hint", Transform{Width: 100}, map[string]string{"Sec-CH-DPR": "lots"}, false, 100, 0},
+        {"width hint snapped", Transform{Quality: 50}, map[string]string{"Sec-CH-Width": "731"}, false, 800, 0},
+        {"width hint capped", Transform{Quality: 50}, map[string]string{"Sec-CH-Width": "100000"}, false, maxDimension, 0},
+        {"viewport hint", Transform{Quality: 50}, map[string]string{"Sec-CH-Viewport-Width": "375", "Sec-CH-DPR": "3"}, false, 1200, 0},
+        {"width hint with only presets", Transform{Quality: 50}, map[string]string{"Sec-CH-Width": "731"}, true, 0, 0},
+        {"dpr hint with only presets", Transform{Width: 100}, map[string]string{"Sec-CH-DPR": "1.9"}, true, 200, 0},
+        {"original", Transform{}, map[string]string{"Sec-CH-Width": "731"}, false, 0, 0},
+    }
+    for _, test := range tests {
+        header := http.Header{}
+        for name, value := range test.headers {
+            header.Set(name, value)
+        }
+        got, _ := applyClientHints(test.t, header, test.onlyPresets)
+        if got.Width != test.width || got.Height != test.height || got.DPR != 0 {
+            t.Errorf("%v: applyClientHints = %vx%v dpr %v, want %vx%v", test.name, got.Width, got.Height, got.DPR, test.width, test.height)
+        }
+    }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/gif"
+    "image/jpeg"
+    "image/png"
+)
+
+const defaultQuality = 90
+
+// Detects the image format from its magic bytes, returning the same names
+// the image package registers decoders under.
+func sniffFormat(body []byte) string {
+    switch {
+    case bytes.HasPrefix(body, []byte{0xFF, 0xD8, 0xFF}):
+        return "jpeg"
+    case bytes.HasPrefix(body, pngSignature):
+        return "png"
+    case bytes.HasPrefix(body, []byte("GIF87a")), bytes.HasPrefix(body, []byte("GIF89a")):
+        return "gif"
+    }
+    return ""
+}
+
+func decodeImage(body []byte) (image.Image, string, error) {
+    err := checkImageLimits(body)
+    if err != nil {
+        return nil, "", err
+    }
+    return image.Decode(bytes.NewReader(body))
+}
+
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+    var buf bytes.Buffer
+    var err error
+    switch format {
+    case "png":
+        err = png.Encode(&buf, img)
+    case "gif":
+        err = gif.Encode(&buf, img, nil)
+    default:
+        // JPEG has no alpha, without flattening transparent areas turn black.
+        if !isOpaque(img) {
+            img = flattenImage(img, color.White)
+        }
+        err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+    }
+    return buf.Bytes(), err
+}
+
+// Binary searches the highest quality between minQuality and maxQuality
+// whose encoding fits into maxBytes. When even minQuality does not fit, that
+// result is returned anyway, as the best we can do.
+func encodeWithinBudget(encode func(quality int) ([]byte, error), maxQuality, maxBytes int) ([]byte, int, error) {
+    low, high := minQuality, maxQuality
+    if low > high {
+        low = high
+    }
+    var best []byte
+    bestQuality := 0
+    for low <= high {
+        quality := (low + high) / 2
+        body, err := encode(quality)
+        if err != nil {
+            return nil, 0, err
+        }
+        if len(body) <= maxBytes {
+            best, bestQuality = body, quality
+            low = quality + 1
+        } else {
+            high = quality - 1
+        }
+    }
+    if best == nil {
+        quality := minQuality
+        if quality > maxQuality {
+            quality = maxQuality
+        }
+        body, err := encode(quality)
+        return body, quality, err
+    }
+    return best, bestQuality, nil
+}
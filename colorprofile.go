@@ -0,0 +1,253 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "log"
+    "math"
+)
+
+// A matrix/TRC ICC profile, which covers the common RGB working spaces
+// like Adobe RGB, Display P3 and ProPhoto RGB. LUT based profiles are not
+// supported.
+type iccProfile struct {
+    description string
+    // Columns are the red, green and blue colorants in D50 XYZ.
+    matrix [3][3]float64
+    curves [3][]float64 // 256 entry lookup tables to linear light
+}
+
+// The D50 colorants of sRGB as they appear in its ICC profile.
+var srgbColorants = [3][3]float64{
+    {0.4361, 0.3851, 0.1431},
+    {0.2225, 0.7169, 0.0606},
+    {0.0139, 0.0971, 0.7141},
+}
+
+// D50 XYZ to linear sRGB, Bradford adapted.
+var xyzToSRGB = [3][3]float64{
+    {3.1338561, -1.6168667, -0.4906146},
+    {-0.9787684, 1.9161415, 0.0334540},
+    {0.0719453, -0.2289914, 1.4052427},
+}
+
+func parseIccProfile(data []byte) (*iccProfile, error) {
+    if len(data) < 132 {
+        return nil, errors.New("profile too short")
+    }
+    if string(data[16:20]) != "RGB " {
+        return nil, fmt.Errorf("unsupported color space %q", data[16:20])
+    }
+
+    tags := map[string][]byte{}
+    count := int(binary.BigEndian.Uint32(data[128:]))
+    for i := 0; i < count; i++ {
+        entry := 132 + i*12
+        if entry+12 > len(data) {
+            return nil, errors.New("truncated tag table")
+        }
+        offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+        size := int(binary.BigEndian.Uint32(data[entry+8:]))
+        if offset < 0 || size < 0 || offset+size > len(data) {
+            return nil, errors.New("tag out of bounds")
+        }
+        tags[string(data[entry:entry+4])] = data[offset : offset+size]
+    }
+
+    profile := &iccProfile{description: readIccText(tags["desc"])}
+    for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+        tag := tags[name]
+        if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+            return nil, fmt.Errorf("missing %v, not a matrix profile", name)
+        }
+        for j := 0; j < 3; j++ {
+            profile.matrix[j][i] = s15Fixed16(tag[8+j*4:])
+        }
+    }
+    for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+        curve, err := readIccCurve(tags[name])
+        if err != nil {
+            return nil, fmt.Errorf("%v: %v", name, err)
+        }
+        profile.curves[i] = curve
+    }
+    return profile, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+    return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func readIccText(tag []byte) string {
+    switch {
+    case len(tag) > 12 && string(tag[:4]) == "desc":
+        n := int(binary.BigEndian.Uint32(tag[8:]))
+        if 12+n <= len(tag) {
+            return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+        }
+    case len(tag) > 28 && string(tag[:4]) == "mluc":
+        // First record, stored as UTF-16BE.
+        n := int(binary.BigEndian.Uint32(tag[20:]))
+        offset := int(binary.BigEndian.Uint32(tag[24:]))
+        if offset+n <= len(tag) {
+            var s []rune
+            for i := offset; i+1 < offset+n; i += 2 {
+                s = append(s, rune(binary.BigEndian.Uint16(tag[i:])))
+            }
+            return string(s)
+        }
+    }
+    return ""
+}
+
+// Builds a lookup table from 8-bit encoded values to linear light.
+func readIccCurve(tag []byte) ([]float64, error) {
+    if len(tag) < 12 {
+        return nil, errors.New("missing curve")
+    }
+    var fn func(x float64) float64
+
+    switch string(tag[:4]) {
+    case "curv":
+        n := int(binary.BigEndian.Uint32(tag[8:]))
+        switch {
+        case n == 0:
+            fn = func(x float64) float64 { return x }
+        case n == 1 && len(tag) >= 14:
+            gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+            fn = func(x float64) float64 { return math.Pow(x, gamma) }
+        case len(tag) >= 12+2*n:
+            table := tag[12 : 12+2*n]
+            fn = func(x float64) float64 {
+                pos := x * float64(n-1)
+                i := int(pos)
+                if i >= n-1 {
+                    return float64(binary.BigEndian.Uint16(table[2*(n-1):])) / 65535
+                }
+                a := float64(binary.BigEndian.Uint16(table[2*i:])) / 65535
+                b := float64(binary.BigEndian.Uint16(table[2*i+2:])) / 65535
+                return a + (b-a)*(pos-float64(i))
+            }
+        default:
+            return nil, errors.New("truncated curve")
+        }
+    case "para":
+        function := int(binary.BigEndian.Uint16(tag[8:]))
+        counts := []int{1, 3, 4, 5, 7}
+        if function >= len(counts) || len(tag) < 12+4*counts[function] {
+            return nil, errors.New("unsupported parametric curve")
+        }
+        p := make([]float64, 7)
+        for i := 0; i < counts[function]; i++ {
+            p[i] = s15Fixed16(tag[12+4*i:])
+        }
+        g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+        fn = func(x float64) float64 {
+            switch function {
+            case 0:
+                return math.Pow(x, g)
+            case 1:
+                if x >= -b/a {
+                    return math.Pow(a*x+b, g)
+                }
+                return 0
+            case 2:
+                if x >= -b/a {
+                    return math.Pow(a*x+b, g) + c
+                }
+                return c
+            case 3:
+                if x >= d {
+                    return math.Pow(a*x+b, g)
+                }
+                return c * x
+            }
+            if x >= d {
+                return math.Pow(a*x+b, g) + e
+            }
+            return c*x + f
+        }
+    default:
+        return nil, fmt.Errorf("unsupported curve type %q", tag[:4])
+    }
+
+    lut := make([]float64, 256)
+    for i := range lut {
+        lut[i] = fn(float64(i) / 255)
+        // Parameters like a negative a make Pow return NaN.
+        if math.IsNaN(lut[i]) || math.IsInf(lut[i], 0) {
+            return nil, errors.New("curve is not finite")
+        }
+    }
+    return lut, nil
+}
+
+// Whether the profile describes sRGB, in which case no conversion is needed.
+func (p *iccProfile) isSRGB() bool {
+    for i := range p.matrix {
+        for j := range p.matrix[i] {
+            if math.Abs(p.matrix[i][j]-srgbColorants[i][j]) > 0.003 {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// Converts img from this profile's color space to sRGB, in place if img
+// already is an *image.NRGBA.
+func (p *iccProfile) toSRGB(img image.Image) *image.NRGBA {
+    var m [3][3]float64
+    for i := 0; i < 3; i++ {
+        for j := 0; j < 3; j++ {
+            for k := 0; k < 3; k++ {
+                m[i][j] += xyzToSRGB[i][k] * p.matrix[k][j]
+            }
+        }
+    }
+
+    // Linear light to sRGB encoded bytes.
+    const steps = 4096
+    encode := make([]uint8, steps+1)
+    for i := range encode {
+        encode[i] = uint8(linearToSRGB(float64(i) / steps))
+    }
+    toByte := func(v float64) uint8 {
+        if math.IsNaN(v) {
+            return 0
+        }
+        v = math.Max(0, math.Min(1, v))
+        return encode[int(v*steps+0.5)]
+    }
+
+    dst := toNRGBA(img)
+    for i := 0; i+3 < len(dst.Pix); i += 4 {
+        r := p.curves[0][dst.Pix[i]]
+        g := p.curves[1][dst.Pix[i+1]]
+        b := p.curves[2][dst.Pix[i+2]]
+        dst.Pix[i] = toByte(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+        dst.Pix[i+1] = toByte(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+        dst.Pix[i+2] = toByte(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+    }
+    return dst
+}
+
+// Returns the embedded profile pixels have to be converted from, or nil if
+// they are sRGB already, the profile is kept, or it is not supported.
+func profileToConvert(meta imageMeta) *iccProfile {
+    if keepIccProfile || len(meta.ICCProfile) == 0 {
+        return nil
+    }
+    profile, err := parseIccProfile(meta.ICCProfile)
+    if err != nil {
+        log.Printf("Not converting unsupported ICC profile: %v", err)
+        return nil
+    }
+    if profile.isSRGB() {
+        return nil
+    }
+    return profile
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "image"
+    "math"
+    "testing"
+)
+
+func paraCurveForTest(function uint16, params ...float64) []byte {
+    var buf bytes.Buffer
+    buf.WriteString("para\x00\x00\x00\x00")
+    binary.Write(&buf, binary.BigEndian, function)
+    buf.Write([]byte{0, 0})
+    for _, p := range params {
+        binary.Write(&buf, binary.BigEndian, int32(p*65536))
+    }
+    return buf.Bytes()
+}
+
+func TestReadIccCurve(t *testing.T) {
+    tests := []struct {
+        name string
+        tag []byte
+        valid bool
+    }{
+        {"missing", nil, false},
+        {"identity", []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), true},
+        {"gamma", []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33"), true},
+        {"truncated table", []byte("curv\x00\x00\x00\x00\x00\x00\x00\x09\x00\x00"), false},
+        {"parametric gamma", paraCurveForTest(0, 2.2), true},
+        {"parametric sRGB", paraCurveForTest(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045), true},
+        {"negative base", paraCurveForTest(3, 2.4, -1, 0.5, 1, 0), false},
+        {"negative gamma at zero", paraCurveForTest(0, -1), false},
+        {"unknown function", paraCurveForTest(9, 1), false},
+        {"unknown type", []byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00"), false},
+    }
+    for _, test := range tests {
+        lut, err := readIccCurve(test.tag)
+        if (err == nil) != test.valid {
+            t.Errorf("%v: readIccCurve error = %v, want valid=%v", test.name, err, test.valid)
+            continue
+        }
+        for i, v := range lut {
+            if math.IsNaN(v) || math.IsInf(v, 0) {
+                t.Errorf("%v: entry %v is %v", test.name, i, v)
+            }
+        }
+    }
+}
+
+func TestToSRGBSurvivesNaN(t *testing.T) {
+    curve := make([]float64, 256)
+    for i := range curve {
+        curve[i] = math.NaN()
+    }
+    profile := &iccProfile{matrix: srgbColorants, curves: [3][]float64{curve, curve, curve}}
+    img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+    for i := range img.Pix {
+        img.Pix[i] = 0x80
+    }
+    dst := profile.toSRGB(img)
+    if dst.Pix[0] != 0 {
+        t.Errorf("NaN converted to %v, want 0", dst.Pix[0])
+    }
+}
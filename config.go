@@ -0,0 +1,158 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+)
+
+// Settings that do not fit into a single env-var are read from the JSON
+// file named by CONFIG_FILE.
+type Config struct {
+    // Named transformations, e.g. "thumb": {"width": 150, "height": 150, "fit": "cover"}
+    Presets map[string]Transform
+    // Reject ad-hoc transform parameters so only presets can be requested.
+    PresetsOnly bool
+    // Groups of presets of increasing width offered together in a srcset,
+    // e.g. "hero": ["hero-small", "hero-medium", "hero-large"]
+    PresetFamilies map[string][]string
+    // Named overlays that presets and routes can refer to.
+    Watermarks map[string]Watermark
+    // Settings that apply to all paths below a prefix.
+    Routes []Route
+    // CORS policy for paths without a route specific one. Any origin is
+    // allowed by default.
+    Cors *Cors
+    // API keys and settings of the teams sharing the deployment, by name.
+    Tenants map[string]*Tenant
+    // Refuse requests without API key instead of serving them from ORIGIN.
+    RequireApiKey bool
+}
+
+type Route struct {
+    Prefix string
+    // Watermark applied to every image below Prefix that has none yet.
+    Watermark string
+    Cors *Cors
+    Hotlink *Hotlink
+}
+
+// Returns the route with the longest prefix matching path, or nil.
+func (c *Config) routeFor(path string) *Route {
+    var match *Route
+    for i, route := range c.Routes {
+        if strings.HasPrefix(path, route.Prefix) && (match == nil || len(route.Prefix) > len(match.Prefix)) {
+            match = &c.Routes[i]
+        }
+    }
+    return match
+}
+
+// Returns the route for a request to the endpoint registered under
+// pattern, matched against the path of the source image it refers to.
+func (c *Config) routeForRequest(r *http.Request, pattern string) *Route {
+    path := r.URL.Path
+    if pattern != "/" {
+        path = strings.TrimPrefix(path, strings.TrimSuffix(pattern, "/"))
+    }
+    if strings.HasPrefix(path, presetPathPrefix) {
+        _, path, _ = splitPresetPath(path)
+    }
+    return c.routeFor(path)
+}
+
+func (c *Config) validate() error {
+    for name, preset := range c.Presets {
+        err := preset.validate()
+        if err != nil {
+            return fmt.Errorf("preset %v: %v", name, err)
+        }
+        if preset.Watermark != "" && c.Watermarks[preset.Watermark].Path == "" {
+            return fmt.Errorf("preset %v: unknown watermark %q", name, preset.Watermark)
+        }
+    }
+    for name, family := range c.PresetFamilies {
+        for _, preset := range family {
+            if c.Presets[preset].Width == 0 {
+                return fmt.Errorf("preset family %v: preset %q is unknown or has no width", name, preset)
+            }
+        }
+    }
+    for name, watermark := range c.Watermarks {
+        err := watermark.validate()
+        if err != nil {
+            return fmt.Errorf("watermark %v: %v", name, err)
+        }
+    }
+    for _, route := range c.Routes {
+        if route.Watermark != "" && c.Watermarks[route.Watermark].Path == "" {
+            return fmt.Errorf("route %v: unknown watermark %q", route.Prefix, route.Watermark)
+        }
+        if route.Cors != nil {
+            if err := route.Cors.validate(); err != nil {
+                return fmt.Errorf("route %v: cors: %v", route.Prefix, err)
+            }
+        }
+        if route.Hotlink != nil {
+            if err := route.Hotlink.validate(); err != nil {
+                return fmt.Errorf("route %v: hotlink: %v", route.Prefix, err)
+            }
+        }
+    }
+    if c.Cors != nil {
+        if err := c.Cors.validate(); err != nil {
+            return fmt.Errorf("cors: %v", err)
+        }
+    }
+    ids, prefixes := map[string]bool{}, map[string]bool{}
+    for name, tenant := range c.Tenants {
+        if err := tenant.validate(c); err != nil {
+            return fmt.Errorf("tenant %v: %v", name, err)
+        }
+        if prefixes[tenant.CachePrefix] {
+            return fmt.Errorf("tenant %v: cache prefix %q is used twice", name, tenant.CachePrefix)
+        }
+        prefixes[tenant.CachePrefix] = true
+        for _, key := range tenant.Keys {
+            if ids[key.Id] {
+                return fmt.Errorf("tenant %v: key id %q is used twice", name, key.Id)
+            }
+            ids[key.Id] = true
+        }
+    }
+    return nil
+}
+
+func loadConfig() *Config {
+    config := &Config{}
+    path := os.Getenv("CONFIG_FILE")
+    if path == "" {
+        log.Println("No CONFIG_FILE given - running with defaults")
+        return config
+    }
+
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        log.Fatalf("Error reading CONFIG_FILE: %v", err)
+    }
+    err = json.Unmarshal(content, config)
+    if err != nil {
+        log.Fatalf("Error parsing CONFIG_FILE: %v", err)
+    }
+    for name, tenant := range config.Tenants {
+        tenant.name = name
+        if tenant.CachePrefix == "" {
+            tenant.CachePrefix = name
+        }
+    }
+    err = config.validate()
+    if err != nil {
+        log.Fatalf("Invalid CONFIG_FILE: %v", err)
+    }
+    log.Printf("Loaded config from %v with %v presets", path, len(config.Presets))
+    return config
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "bytes"
+    "encoding/xml"
+    "fmt"
+    "log"
+    "mime"
+    "net/http"
+    "os"
+    "strings"
+)
+
+// What to do with SVG origin responses. SVG is a document format that can
+// carry scripts, so it is refused unless SVG_MODE=sanitize.
+const (
+    svgReject = "reject"
+    svgSanitize = "sanitize"
+)
+
+func svgSetting() string {
+    mode := strings.ToLower(os.Getenv("SVG_MODE"))
+    switch mode {
+    case "":
+        return svgReject
+    case svgReject, svgSanitize:
+        return mode
+    }
+    log.Fatalf("Error parsing SVG_MODE: expected %v or %v, got %q", svgReject, svgSanitize, mode)
+    return ""
+}
+
+// Determines the MIME type from the body alone. The formats we decode come
+// first, then the ones we only pass through.
+func sniffContentType(body []byte) string {
+    if format := sniffFormat(body); format != "" {
+        return "image/" + format
+    }
+    if len(body) >= 12 && string(body[4:8]) == "ftyp" {
+        switch string(body[8:12]) {
+        case "avif", "avis":
+            return "image/avif"
+        case "heic", "heix", "mif1":
+            return "image/heic"
+        }
+    }
+    if isSvg(body) {
+        return "image/svg+xml"
+    }
+    contentType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+    return contentType
+}
+
+// Checks an origin response against its body before it gets cached. The
+// Content-Type is taken from the sniffed format rather than from the
+// origin. Bodies that are no image, or an image type outside of
+// ALLOWED_CONTENT_TYPES if that is set, are replaced by a 502 response. The
+// list applies to the formats we decode as well, SVG needs SVG_MODE on top.
+func checkContentType(data ResponseData) ResponseData {
+    if data.StatusCode != 200 {
+        // Error pages are not passed on, they could be HTML.
+        return ResponseData{
+            ContentType: "text/plain",
+            Body: []byte(fmt.Sprintf("Origin responded with status %v", data.StatusCode)),
+            StatusCode: data.StatusCode,
+        }
+    }
+
+    sniffed := sniffContentType(data.Body)
+    declared, _, _ := mime.ParseMediaType(data.ContentType)
+    if declared != sniffed {
+        log.Printf("Origin declared Content-Type=%q, sniffed %v", data.ContentType, sniffed)
+    }
+
+    switch {
+    case !strings.HasPrefix(sniffed, "image/"):
+        return refusedResponse(fmt.Sprintf("origin response of type %v is no image", sniffed))
+    case len(allowedContentTypes) > 0 && !contains(allowedContentTypes, sniffed):
+        return refusedResponse(fmt.Sprintf("origin response of type %v is not accepted", sniffed))
+    case sniffed == "image/svg+xml":
+        if svgMode != svgSanitize {
+            return refusedResponse("SVG images are not accepted")
+        }
+        body, err := sanitizeSvg(data.Body)
+        if err != nil {
+            return refusedResponse(fmt.Sprintf("cannot sanitize SVG: %v", err))
+        }
+        data.Body = body
+    }
+    data.ContentType = sniffed
+    return data
+}
+
+func refusedResponse(reason string) ResponseData {
+    log.Printf("Refusing origin response: %v", reason)
+    return ResponseData{
+        ContentType: "text/plain",
+        Body: []byte(reason),
+        StatusCode: http.StatusBadGateway,
+    }
+}
+
+func contains(list []string, value string) bool {
+    for _, item := range list {
+        if item == value {
+            return true
+        }
+    }
+    return false
+}
+
+// Keeps browsers from second-guessing the Content-Type we send, which is
+// what makes serving user supplied files from our domain safe.
+func noSniff(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        handler(w, r)
+    }
+}
+
+// An SVG document has <svg> as its root element, after an optional XML
+// declaration, comments and doctype.
+func isSvg(body []byte) bool {
+    decoder := xml.NewDecoder(bytes.NewReader(body))
+    decoder.Strict = false
+    for {
+        token, err := decoder.RawToken()
+        if err != nil {
+            return false
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            return t.Name.Local == "svg"
+        case xml.CharData:
+            if len(bytes.TrimSpace(t)) > 0 {
+                return false
+            }
+        }
+    }
+}
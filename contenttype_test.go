@@ -0,0 +1,34 @@
+package main
+
+import (
+    "image"
+    "testing"
+)
+
+func TestCheckContentTypeAllowlist(t *testing.T) {
+    defer func(previous []string) { allowedContentTypes = previous }(allowedContentTypes)
+    img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+    jpegBody, _ := encodeImage(img, "jpeg", defaultQuality)
+    pngBody, _ := encodeImage(img, "png", defaultQuality)
+    gifBody, _ := encodeImage(img, "gif", defaultQuality)
+
+    tests := []struct {
+        name string
+        allowed []string
+        body []byte
+        status int
+    }{
+        {"any image by default", nil, jpegBody, 200},
+        {"allowed", []string{"image/png"}, pngBody, 200},
+        {"jpeg outside of the list", []string{"image/png"}, jpegBody, 502},
+        {"gif outside of the list", []string{"image/png"}, gifBody, 502},
+        {"no image", nil, []byte("<html></html>"), 502},
+    }
+    for _, test := range tests {
+        allowedContentTypes = test.allowed
+        data := checkContentType(ResponseData{ContentType: "image/png", Body: test.body, StatusCode: 200})
+        if data.StatusCode != test.status {
+            t.Errorf("%v: checkContentType gave status %v, want %v", test.name, data.StatusCode, test.status)
+        }
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+type Cors struct {
+    // Exact origins like "https://example.com", patterns with one wildcard
+    // like "https://*.example.com", or "*" for any origin.
+    AllowedOrigins []string
+    // Methods allowed in preflight requests, GET and HEAD if empty.
+    AllowedMethods []string
+    // Request headers allowed in preflight requests.
+    AllowedHeaders []string
+    // Allow cookies and HTTP authentication. Requires explicit origins.
+    AllowCredentials bool
+    // Seconds a browser may cache the preflight response.
+    MaxAge int
+}
+
+var defaultCors = &Cors{AllowedOrigins: []string{"*"}}
+
+func (c *Cors) validate() error {
+    if len(c.AllowedOrigins) == 0 {
+        return errors.New("no allowed origins")
+    }
+    for _, origin := range c.AllowedOrigins {
+        if origin == "*" && c.AllowCredentials {
+            return errors.New("credentials cannot be allowed for any origin")
+        }
+        if strings.Count(origin, "*") > 1 {
+            return errors.New("origin patterns can contain a single *")
+        }
+    }
+    if c.MaxAge < 0 {
+        return errors.New("maxAge must not be negative")
+    }
+    return nil
+}
+
+func (c *Cors) allowsAnyOrigin() bool {
+    return contains(c.AllowedOrigins, "*")
+}
+
+func (c *Cors) allowsOrigin(origin string) bool {
+    for _, allowed := range c.AllowedOrigins {
+        star := strings.Index(allowed, "*")
+        if star < 0 {
+            if allowed == origin {
+                return true
+            }
+            continue
+        }
+        prefix, suffix := allowed[:star], allowed[star+1:]
+        if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+            return true
+        }
+    }
+    return false
+}
+
+func (c *Cors) methods() []string {
+    if len(c.AllowedMethods) == 0 {
+        return []string{"GET", "HEAD"}
+    }
+    return c.AllowedMethods
+}
+
+// The CORS policy of the route a request belongs to.
+func corsFor(r *http.Request, pattern string) *Cors {
+    if route := config.routeForRequest(r, pattern); route != nil && route.Cors != nil {
+        return route.Cors
+    }
+    if config.Cors != nil {
+        return config.Cors
+    }
+    return defaultCors
+}
+
+// Adds the CORS headers of the route to every response and answers
+// preflight requests without calling handler.
+func withCors(pattern string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        cors := corsFor(r, pattern)
+        allowed := addCorsHeaders(w, r, cors)
+
+        if r.Method != "OPTIONS" {
+            handler(w, r)
+            return
+        }
+        w.Header().Set("Allow", strings.Join(append(cors.methods(), "OPTIONS"), ", "))
+        if allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+            w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.methods(), ", "))
+            if len(cors.AllowedHeaders) > 0 {
+                w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+            }
+            if cors.MaxAge > 0 {
+                w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+            }
+        }
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// Returns whether the request origin is allowed. Specific origins are
+// echoed, so the response varies with the Origin header then.
+func addCorsHeaders(w http.ResponseWriter, r *http.Request, cors *Cors) bool {
+    if cors.allowsAnyOrigin() {
+        w.Header().Set("Access-Control-Allow-Origin", "*")
+        return true
+    }
+    w.Header().Add("Vary", "Origin")
+    origin := r.Header.Get("Origin")
+    if origin == "" || !cors.allowsOrigin(origin) {
+        return false
+    }
+    w.Header().Set("Access-Control-Allow-Origin", origin)
+    if cors.AllowCredentials {
+        w.Header().Set("Access-Control-Allow-Credentials", "true")
+    }
+    return true
+}
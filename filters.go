@@ -0,0 +1,183 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "math"
+)
+
+const (
+    // Blur and sharpen keep a float64 copy of every pixel, so they are only
+    // done on outputs of bounded size.
+    maxFilterPixels = 4 * 1000 * 1000
+    // Larger blurs are done on a downscaled copy, which looks the same but
+    // keeps the kernel short.
+    maxDirectSigma = 2.0
+)
+
+// Filters run after resizing, always in this order: brightness, contrast,
+// saturation, grayscale, sepia, blur, sharpen. That way a blurred
+// background and a sharpened thumbnail of the same preset look the same no
+// matter in which order the parameters were given.
+func applyFilters(img image.Image, t Transform) image.Image {
+    if !t.hasFilters() {
+        return img
+    }
+    dst := toNRGBA(img)
+    if t.Brightness != 0 || t.Contrast != 0 || t.Saturation != 0 || t.Grayscale || t.Sepia {
+        adjustColors(dst, t)
+    }
+    if t.Blur > 0 {
+        dst = blurImage(dst, t.Blur)
+    }
+    if t.Sharpen > 0 {
+        dst = unsharpMask(dst, 1.0, t.Sharpen)
+    }
+    return dst
+}
+
+func (t Transform) hasFilters() bool {
+    return t.Brightness != 0 || t.Contrast != 0 || t.Saturation != 0 ||
+        t.Grayscale || t.Sepia || t.Blur > 0 || t.Sharpen > 0
+}
+
+// Blur and sharpen work on the output, after resizing the srcW x srcH
+// upright source, which has to stay within maxFilterPixels.
+func (t Transform) checkFilterSize(srcW, srcH int) error {
+    if t.Blur == 0 && t.Sharpen == 0 {
+        return nil
+    }
+    if t.Rotate == 90 || t.Rotate == 270 {
+        srcW, srcH = srcH, srcW
+    }
+    w, h, _ := resizeTarget(srcW, srcH, t)
+    if w*h > maxFilterPixels {
+        return fmt.Errorf("blur and sharpen are limited to %v pixels, resize the image with w or h", maxFilterPixels)
+    }
+    return nil
+}
+
+func luminance(r, g, b float64) float64 {
+    return 0.299*r + 0.587*g + 0.114*b
+}
+
+// Brightness, contrast and saturation range from -100 to 100.
+func adjustColors(img *image.NRGBA, t Transform) {
+    brightness := float64(t.Brightness) / 100 * 255
+    contrast := float64(100+t.Contrast) / 100
+    saturation := float64(100+t.Saturation) / 100
+
+    for i := 0; i+3 < len(img.Pix); i += 4 {
+        r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+
+        r, g, b = r+brightness, g+brightness, b+brightness
+        r = (r-128)*contrast + 128
+        g = (g-128)*contrast + 128
+        b = (b-128)*contrast + 128
+        if saturation != 1 {
+            l := luminance(r, g, b)
+            r, g, b = l+(r-l)*saturation, l+(g-l)*saturation, l+(b-l)*saturation
+        }
+        if t.Grayscale {
+            l := luminance(r, g, b)
+            r, g, b = l, l, l
+        }
+        if t.Sepia {
+            r, g, b = 0.393*r+0.769*g+0.189*b, 0.349*r+0.686*g+0.168*b, 0.272*r+0.534*g+0.131*b
+        }
+
+        img.Pix[i], img.Pix[i+1], img.Pix[i+2] = clampByte(r), clampByte(g), clampByte(b)
+    }
+}
+
+func gaussianKernel(sigma float64) []float64 {
+    radius := int(math.Ceil(sigma * 3))
+    kernel := make([]float64, 2*radius+1)
+    sum := 0.0
+    for i := range kernel {
+        x := float64(i - radius)
+        kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+        sum += kernel[i]
+    }
+    for i := range kernel {
+        kernel[i] /= sum
+    }
+    return kernel
+}
+
+func blurImage(src *image.NRGBA, sigma float64) *image.NRGBA {
+    if sigma <= maxDirectSigma {
+        return gaussianBlur(src, sigma)
+    }
+    w, h := src.Rect.Dx(), src.Rect.Dy()
+    scale := maxDirectSigma / sigma
+    small := resample(src, atLeastOne(int(float64(w)*scale+0.5)), atLeastOne(int(float64(h)*scale+0.5)))
+    blurred := gaussianBlur(small, sigma*float64(small.Rect.Dx())/float64(w))
+    return resample(blurred, w, h)
+}
+
+// Separable gaussian blur on premultiplied alpha, edges are clamped.
+func gaussianBlur(src *image.NRGBA, sigma float64) *image.NRGBA {
+    kernel := gaussianKernel(sigma)
+    radius := len(kernel) / 2
+    w, h := src.Rect.Dx(), src.Rect.Dy()
+
+    clamp := func(v, limit int) int {
+        if v < 0 {
+            return 0
+        }
+        if v >= limit {
+            return limit - 1
+        }
+        return v
+    }
+
+    tmp := make([]float64, w*h*4)
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            var r, g, b, a float64
+            for k, v := range kernel {
+                p := src.Pix[src.PixOffset(clamp(x+k-radius, w), y):]
+                alpha := float64(p[3]) * v
+                r += float64(p[0]) * alpha
+                g += float64(p[1]) * alpha
+                b += float64(p[2]) * alpha
+                a += alpha
+            }
+            o := (y*w + x) * 4
+            tmp[o], tmp[o+1], tmp[o+2], tmp[o+3] = r, g, b, a
+        }
+    }
+
+    dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            var r, g, b, a float64
+            for k, v := range kernel {
+                o := (clamp(y+k-radius, h)*w + x) * 4
+                r += tmp[o] * v
+                g += tmp[o+1] * v
+                b += tmp[o+2] * v
+                a += tmp[o+3] * v
+            }
+            d := dst.Pix[dst.PixOffset(x, y):]
+            if a > 0 {
+                d[0], d[1], d[2], d[3] = clampByte(r/a), clampByte(g/a), clampByte(b/a), clampByte(a)
+            }
+        }
+    }
+    return dst
+}
+
+// Sharpens by adding amount times the difference to a blurred copy.
+func unsharpMask(src *image.NRGBA, sigma, amount float64) *image.NRGBA {
+    blurred := gaussianBlur(src, sigma)
+    for i := 0; i+3 < len(src.Pix); i += 4 {
+        for c := 0; c < 3; c++ {
+            v := float64(src.Pix[i+c])
+            blurred.Pix[i+c] = clampByte(v + (v-float64(blurred.Pix[i+c]))*amount)
+        }
+        blurred.Pix[i+3] = src.Pix[i+3]
+    }
+    return blurred
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "image"
+    "testing"
+)
+
+func TestCheckFilterSize(t *testing.T) {
+    tests := []struct {
+        name string
+        t Transform
+        srcW, srcH int
+        ok bool
+    }{
+        {"no filter on a large source", Transform{}, 8000, 6000, true},
+        {"blur on a small source", Transform{Blur: 5}, 800, 600, true},
+        {"blur on a large source", Transform{Blur: 5}, 8000, 6000, false},
+        {"blur with a width", Transform{Blur: 20, Width: 800}, 8000, 6000, true},
+        {"blur with a height", Transform{Blur: 20, Height: 800}, 8000, 6000, true},
+        {"width on a narrow source", Transform{Blur: 20, Width: 800}, 1000, 40000, false},
+        {"width that is not upscaled", Transform{Sharpen: 1, Width: 8000}, 1000, 1000, true},
+        {"cover", Transform{Blur: 1, Width: 2000, Height: 2000, Fit: "cover"}, 8000, 6000, true},
+        {"cover too large", Transform{Blur: 1, Width: 3000, Height: 3000, Fit: "cover"}, 8000, 6000, false},
+        {"rotated", Transform{Blur: 1, Width: 1000, Rotate: 90}, 8000, 1000, false},
+    }
+    for _, test := range tests {
+        if err := test.t.checkFilterSize(test.srcW, test.srcH); (err == nil) != test.ok {
+            t.Errorf("%v: checkFilterSize = %v, want ok=%v", test.name, err, test.ok)
+        }
+    }
+}
+
+func TestBlurImageKeepsSize(t *testing.T) {
+    img := image.NewNRGBA(image.Rect(0, 0, 300, 7))
+    for _, sigma := range []float64{0.5, maxDirectSigma, 50, 100} {
+        if b := blurImage(img, sigma).Bounds(); b != img.Bounds() {
+            t.Errorf("blurImage(%v) changed the size to %v", sigma, b)
+        }
+    }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "image"
+    "image/draw"
+    "strings"
+)
+
+func toNRGBA(img image.Image) *image.NRGBA {
+    if n, ok := img.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+        return n
+    }
+    b := img.Bounds()
+    dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+    draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+    return dst
+}
+
+// Builds a w x h image where every destination pixel (x, y) is copied from
+// the source pixel returned by fn.
+func remap(img image.Image, w, h int, fn func(x, y int) (int, int)) *image.NRGBA {
+    src := toNRGBA(img)
+    dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            sx, sy := fn(x, y)
+            copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):])
+        }
+    }
+    return dst
+}
+
+func rotate90(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+}
+
+func rotate180(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+}
+
+func rotate270(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+}
+
+func flipHorizontal(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+}
+
+func flipVertical(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+}
+
+func transpose(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, h, w, func(x, y int) (int, int) { return y, x })
+}
+
+func transverse(img image.Image) *image.NRGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    return remap(img, h, w, func(x, y int) (int, int) { return w - 1 - y, h - 1 - x })
+}
+
+// Turns an image stored with the given EXIF orientation into one that
+// displays upright without the tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+    switch orientation {
+    case 2:
+        return flipHorizontal(img)
+    case 3:
+        return rotate180(img)
+    case 4:
+        return flipVertical(img)
+    case 5:
+        return transpose(img)
+    case 6:
+        return rotate90(img)
+    case 7:
+        return transverse(img)
+    case 8:
+        return rotate270(img)
+    }
+    return img
+}
+
+// Applies the explicit rotate and flip transform parameters.
+func rotateAndFlip(img image.Image, degrees int, flip string) image.Image {
+    switch degrees {
+    case 90:
+        img = rotate90(img)
+    case 180:
+        img = rotate180(img)
+    case 270:
+        img = rotate270(img)
+    }
+    if strings.Contains(flip, "h") {
+        img = flipHorizontal(img)
+    }
+    if strings.Contains(flip, "v") {
+        img = flipVertical(img)
+    }
+    return img
+}
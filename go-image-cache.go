@@ -1,14 +1,19 @@
 package main
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
     "log"
     "os"
     "time"
     "net/http"
     "net/url"
+    "io"
     "io/ioutil"
+    "strconv"
     "strings"
+    "sync"
     "encoding/json"
     "github.com/dustin/gomemcached/client"
     "github.com/yvasiyarov/gorelic"
@@ -18,6 +23,16 @@ type ResponseData struct {
     ContentType string
     Body []byte
     StatusCode int
+    // EXIF orientation of the origin image before normalization.
+    Orientation int
+    // Encoder quality chosen to meet a maxbytes budget.
+    Quality int
+    // Seconds to wait before retrying a 429 or 503 response.
+    RetryAfter int
+    // Unix time a source was loaded from the origin.
+    FetchedAt int64
+    // The cache key the entry was stored under, before hashing.
+    Key string
 }
 
 var (
@@ -25,27 +40,67 @@ var (
   cacheSince = time.Now().Format(http.TimeFormat)
 	cacheUntil = time.Now().AddDate(60, 0, 0).Format(http.TimeFormat)
   vBucket = (uint16)(0)
-  client = initMemcacheClient()
+  client *memcached.Client // connected in main
+  clientLock sync.Mutex // the memcached client is not safe for concurrent use
   newRelicAgent = initNewRelicAgent()
+  config = loadConfig()
+  keepIccProfile = boolSetting("KEEP_ICC_PROFILE")
+  keepCopyright = boolSetting("KEEP_COPYRIGHT")
+  maxInputBytes = intSetting("MAX_INPUT_BYTES", 20 * 1024 * 1024)
+  maxInputPixels = intSetting("MAX_INPUT_PIXELS", 50 * 1000 * 1000)
+  maxInputDimension = intSetting("MAX_INPUT_DIMENSION", 16384)
+  maxInputFrames = intSetting("MAX_INPUT_FRAMES", 500)
+  maxAnimationPixels = intSetting("MAX_ANIMATION_PIXELS", 200 * 1000 * 1000)
+  minQuality = intSetting("MIN_QUALITY", 30)
+  signingKeys = initSigningKeys()
+  allowedContentTypes = listSetting("ALLOWED_CONTENT_TYPES")
+  svgMode = svgSetting()
+  trustedProxies = listSetting("TRUSTED_PROXIES")
+  rateLimitKeyHeader = os.Getenv("RATE_LIMIT_KEY_HEADER")
+  rateLimit = initRateLimiter()
+  originLimit = initOriginLimiter()
+  // Whole origin requests including the body, so slow origins free their slot.
+  originClient = &http.Client{Timeout: time.Duration(intSetting("ORIGIN_TIMEOUT", 10000)) * time.Millisecond}
+  sourceTTL = intSetting("SOURCE_TTL", 0)
+  ignoredParams = ignoredParamsSetting()
+  lowercasePaths = boolSetting("CANONICAL_LOWERCASE")
+  cacheKeyPrefix = cacheKeyPrefixSetting()
  )
 
 func main(){
+    client = initMemcacheClient()
 
-    handler := handleHttp
     if newRelicAgent != nil{
-        log.Println("Wrapping request handler with newRelicAgent")
-        handler = newRelicAgent.WrapHTTPHandlerFunc(handler)
+        log.Println("Wrapping request handlers with newRelicAgent")
     }
-    http.HandleFunc("/", handler)
-
-    port := portSetting()
-    log.Printf("Cache listening on port:%v", port)
-    err := http.ListenAndServe(port, nil)
+    handle("/", handleHttp)
+    handle(lqipPathPrefix + "/", handleLqip)
+    handle(infoPathPrefix + "/", handleInfo)
+    handle(srcsetPathPrefix + "/", handleSrcset)
+    handle(spritePath, handleSprite)
+    handle(spriteMapPath, handleSpriteMap)
+    http.HandleFunc("/_metrics", handleMetrics)
+
+    err := listenAndServe(portSetting())
     if err != nil {
         panic(err)
     }
 }
 
+func handle(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+    // From the innermost to the outermost wrapper.
+    handler = requireSignature(handler)
+    handler = withRateLimit(handler)
+    handler = withTenant(handler)
+    handler = withHotlinkProtection(pattern, handler)
+    handler = withCors(pattern, handler)
+    handler = noSniff(handler)
+    if newRelicAgent != nil{
+        handler = newRelicAgent.WrapHTTPHandlerFunc(handler)
+    }
+    http.HandleFunc(pattern, handler)
+}
+
 func initNewRelicAgent() *gorelic.Agent {
     license := os.Getenv("NEW_RELIC_LICENSE_KEY")
     if license == "" {
@@ -95,18 +150,128 @@ func initMemcacheClient() *memcached.Client {
 }
 
 func handleHttp(w http.ResponseWriter, r *http.Request) {
-    cacheKey := r.URL.String()
-    responseData := loadFromCache(cacheKey)
+    tenant := tenantFor(r)
+    if tenant != nil {
+        if err := tenant.checkPresets(r.URL); err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+    }
+    transform, sourceUrl, err := parseTransform(r.URL)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    onlyPresets := config.PresetsOnly || tenant != nil && len(tenant.Presets) > 0
+    transform, hints := applyClientHints(transform, r.Header, onlyPresets)
+    addClientHintHeaders(w, hints)
+
+    budget := missBudgetFor(r)
+    if transform.isEmpty() {
+        source, _ := loadSource(sourceUrl, budget)
+        serveResponse(*source, w)
+        return
+    }
 
-    if responseData == nil {
-        fmt.Println("Not found on Cache: ", cacheKey)
-        responseData = loadFromOrigin(r.URL)
-        cacheResponse(cacheKey, *responseData)
-    }else{
+    responseData, err := loadVariant(sourceUrl, transform, budget)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+    serveResponse(*responseData, w)
+}
+
+// Returns the transformed variant of the source image at sourceUrl, from
+// cache if possible. Failed source responses are returned as they are.
+func loadVariant(sourceUrl *url.URL, transform Transform, budget func() *ResponseData) (*ResponseData, error) {
+    variantKey := cacheKeyFor(sourceUrl) + "#" + transform.key()
+    responseData := loadFromCache(variantKey)
+    if responseData != nil {
+        fmt.Println("Serving variant from cache: ", variantKey)
+        return responseData, nil
+    }
+
+    source, _ := loadSource(sourceUrl, budget)
+    if source.StatusCode != 200 {
+        return source, nil
+    }
+    fmt.Println("Transforming variant: ", variantKey)
+    variant, err := applyTransform(*source, transform)
+    if err != nil {
+        return nil, err
+    }
+    cacheResponse(variantKey, variant)
+    return &variant, nil
+}
+
+// Returns the normalized source image for u, from cache if possible, and
+// whether it was found in the cache. Unless budget is nil it is asked
+// before going to the origin, and its response returned if it refuses.
+// Sources older than SOURCE_TTL are fetched again, their stale copy is
+// served when that is not possible right now.
+func loadSource(u *url.URL, budget func() *ResponseData) (*ResponseData, bool) {
+    cacheKey := cacheKeyFor(u)
+    stale := loadFromCache(cacheKey)
+
+    if stale != nil && !isStale(stale) {
         fmt.Println("Serving from cache: ", cacheKey)
+        return stale, true
     }
 
-    serveResponse(*responseData, w)
+    fmt.Println("Not found on Cache: ", cacheKey)
+    if budget != nil {
+        if limited := budget(); limited != nil {
+            if stale != nil {
+                return stale, true
+            }
+            return limited, false
+        }
+    }
+
+    done, err := originLimit.acquire(originFor(u.Host))
+    if err != nil {
+        log.Printf("Shedding origin request for %v: %v", cacheKey, err)
+        if stale != nil {
+            fmt.Println("Serving stale from cache: ", cacheKey)
+            return stale, true
+        }
+        return &ResponseData{
+            ContentType: "text/plain",
+            Body: []byte("Origin is busy"),
+            StatusCode: http.StatusServiceUnavailable,
+            RetryAfter: 1,
+        }, false
+    }
+    responseData := loadFromOrigin(u)
+    done()
+
+    if responseData == nil {
+        if stale != nil {
+            return stale, true
+        }
+        return &ResponseData{
+            ContentType: "text/plain",
+            Body: []byte("Error loading from origin"),
+            StatusCode: http.StatusBadGateway,
+        }, false
+    }
+    *responseData = normalizeImage(*responseData)
+    responseData.FetchedAt = time.Now().Unix()
+    cacheResponse(cacheKey, *responseData)
+    return responseData, false
+}
+
+func isStale(data *ResponseData) bool {
+    return sourceTTL > 0 && time.Now().Unix() - data.FetchedAt > int64(sourceTTL)
+}
+
+// The source URL for endpoints that take the image path after a prefix,
+// like /_info/some/image.jpg.
+func sourceUrlFor(r *http.Request, prefix string) *url.URL {
+    sourceUrl := *r.URL
+    sourceUrl.Path = strings.TrimPrefix(r.URL.Path, prefix)
+    sourceUrl.RawPath = ""
+    return &sourceUrl
 }
 
 
@@ -117,6 +282,7 @@ func cacheResponse(key string, data ResponseData) {
         return
     }
 
+    data.Key = key
     dump, err := serialize(data)
     if err != nil {
         fmt.Println("Serialization error:", err.Error())
@@ -129,7 +295,9 @@ func cacheResponse(key string, data ResponseData) {
         return
     }
 
-    _, err = client.Set(vBucket, key, 0, 0, dump)
+    clientLock.Lock()
+    _, err = client.Set(vBucket, memcachedKey(key), 0, 0, dump)
+    clientLock.Unlock()
     if err != nil {
         log.Printf("Error caching key: %v", err)
     }
@@ -137,12 +305,62 @@ func cacheResponse(key string, data ResponseData) {
 }
 
 func loadFromCache(key string) *ResponseData {
-    resp, err := client.Get(vBucket, key)
+    clientLock.Lock()
+    resp, err := client.Get(vBucket, memcachedKey(key))
+    clientLock.Unlock()
     if err != nil {
         log.Printf("Error retrieving key: %v", err)
         return nil
     }
-    return deserialize(resp.Body)
+    data := deserialize(resp.Body)
+    if data != nil && data.Key != key {
+        log.Printf("Cache entry for key=%v belongs to key=%v, ignoring it", key, data.Key)
+        return nil
+    }
+    return data
+}
+
+// Memcached keys are limited to 250 bytes without spaces or control
+// characters, so entries are stored under CACHE_KEY_PREFIX, the tenant
+// namespace of the key and its SHA-256.
+func memcachedKey(key string) string {
+    hash := sha256.Sum256([]byte(key))
+    if namespace := keyNamespace(key); namespace != "" {
+        return cacheKeyPrefix + namespace + ":" + hex.EncodeToString(hash[:])
+    }
+    return cacheKeyPrefix + hex.EncodeToString(hash[:])
+}
+
+const (
+    namespaceKeyPrefix = "tenant:"
+    // Limits of CACHE_KEY_PREFIX and tenant cache prefixes, which keep
+    // memcached keys within 250 bytes.
+    maxKeyPrefixLength = 100
+    maxNamespaceLength = 64
+)
+
+// The cache key of the source at u. The tenant namespace in u.Host is
+// spelled out as "tenant:<prefix>|" in front of the path, which no request
+// path can produce, anonymous keys are the path alone.
+func cacheKeyFor(u *url.URL) string {
+    local := *u
+    local.Host = ""
+    if u.Host == "" {
+        return local.String()
+    }
+    return namespaceKeyPrefix + u.Host + "|" + local.String()
+}
+
+// The namespace of keys made by cacheKeyFor, empty for anonymous ones.
+func keyNamespace(key string) string {
+    if !strings.HasPrefix(key, namespaceKeyPrefix) {
+        return ""
+    }
+    rest := key[len(namespaceKeyPrefix):]
+    if bar := strings.Index(rest, "|"); bar >= 0 {
+        return rest[:bar]
+    }
+    return ""
 }
 
 func serialize(data ResponseData) ( []byte, error ){
@@ -162,8 +380,15 @@ func deserialize(dump []byte) *ResponseData {
 func serveResponse(data ResponseData, w http.ResponseWriter) {
     log.Printf("Setting Content-Type=%v", data.ContentType)
     w.Header().Set("Content-Type", data.ContentType)
-    addCacheHeaders(w)
-    addCorsHeaders(w)
+    if data.Quality > 0 {
+        w.Header().Set("X-Image-Quality", strconv.Itoa(data.Quality))
+    }
+    if data.RetryAfter > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(data.RetryAfter))
+    }
+    if data.StatusCode == 200 {
+        addCacheHeaders(w)
+    }
     w.WriteHeader(data.StatusCode)
     w.Write(data.Body)
 }
@@ -173,30 +398,35 @@ func addCacheHeaders(w http.ResponseWriter) {
     w.Header().Add("Last-Modified", cacheSince)
     w.Header().Add("Expires", cacheUntil)
 }
-func addCorsHeaders(w http.ResponseWriter){
-    w.Header().Add("Access-Control-Allow-Origin", "*")
-}
-
-func loadFromOrigin(url *url.URL) *ResponseData {
-    urlString := url.String()
 
-    originUrl := strings.Replace(urlString, url.Host, originHost(), 1)
+// Loads u from the origin of its cache namespace, which is in u.Host.
+func loadFromOrigin(u *url.URL) *ResponseData {
+    path := *u
+    path.Host = ""
+    originUrl := originFor(u.Host) + path.String()
     fmt.Println("Loading from origin url=", originUrl )
-    resp, err := http.Get(originUrl)
+    resp, err := originClient.Get(originUrl)
     if err != nil {
-        fmt.Println("Error while loading: %s", err.Error())
+        fmt.Println("Error while loading:", err.Error())
         return nil
     }
 
     defer resp.Body.Close()
-    body, err := ioutil.ReadAll(resp.Body)
+    body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxInputBytes) + 1))
+    if err != nil {
+        fmt.Println("Error while reading:", err.Error())
+        return nil
+    }
+    if len(body) > maxInputBytes {
+        rejected := rejectedResponse(rejectImage("origin response exceeds the limit of %v bytes", maxInputBytes))
+        return &rejected
+    }
 
-    resp.Body.Read(body)
-    data := ResponseData{
+    data := checkContentType(ResponseData{
         ContentType: resp.Header.Get("Content-Type"),
         Body: body,
         StatusCode: resp.StatusCode,
-    }
+    })
     return &data
 }
 
@@ -209,6 +439,50 @@ func originHost() string{
     return origin
 }
 
+func boolSetting(name string) bool {
+    value := strings.ToLower(os.Getenv(name))
+    return value == "1" || value == "true" || value == "yes"
+}
+
+func intSetting(name string, fallback int) int {
+    value := os.Getenv(name)
+    if value == "" {
+        return fallback
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        log.Fatalf("Error parsing %v: %v", name, err)
+    }
+    return n
+}
+
+// A comma separated list, empty if unset.
+func listSetting(name string) []string {
+    var list []string
+    for _, value := range strings.Split(os.Getenv(name), ",") {
+        if value = strings.TrimSpace(value); value != "" {
+            list = append(list, value)
+        }
+    }
+    return list
+}
+
+// CACHE_KEY_PREFIX goes into every memcached key as it is, so it must not
+// break the key syntax nor the length limit of 250 bytes. Together with a
+// tenant prefix and the hash it stays below that.
+func cacheKeyPrefixSetting() string {
+    prefix := os.Getenv("CACHE_KEY_PREFIX")
+    if len(prefix) > maxKeyPrefixLength {
+        log.Fatalf("Error parsing CACHE_KEY_PREFIX: longer than %v bytes", maxKeyPrefixLength)
+    }
+    for _, c := range prefix {
+        if c <= ' ' || c >= 0x7f {
+            log.Fatalf("Error parsing CACHE_KEY_PREFIX: only printable ASCII without spaces is allowed, got %q", prefix)
+        }
+    }
+    return prefix
+}
+
 func portSetting() string {
     port := os.Getenv("PORT")
     if port == "" {
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// Keeps other sites from embedding the images of a route. Requests are
+// recognized by their Referer, or Origin if there is none.
+type Hotlink struct {
+    // Domains like "example.com", or "*.example.com" for all its subdomains.
+    AllowedDomains []string
+    // Allow requests without Referer and Origin, like direct visits and
+    // privacy conscious browsers.
+    AllowEmpty bool
+    // What other sites get: "deny" (403, the default), "redirect" or
+    // "placeholder".
+    Action string
+    // Target of the redirect action.
+    RedirectUrl string
+    // Path of the image on the origin served by the placeholder action.
+    Placeholder string
+}
+
+var hotlinkRejections = newCounter("hotlink.rejected")
+
+func (h *Hotlink) validate() error {
+    for _, domain := range h.AllowedDomains {
+        if strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+            return fmt.Errorf("invalid domain %q, wildcards are only allowed as *.example.com", domain)
+        }
+    }
+    switch h.Action {
+    case "", "deny":
+    case "redirect":
+        if h.RedirectUrl == "" {
+            return errors.New("redirect needs a redirectUrl")
+        }
+    case "placeholder":
+        if _, err := canonicalUrl(h.Placeholder); err != nil || !strings.HasPrefix(h.Placeholder, "/") {
+            return errors.New("placeholder needs a path starting with /")
+        }
+    default:
+        return fmt.Errorf("unknown action %q", h.Action)
+    }
+    return nil
+}
+
+func (h *Hotlink) allows(r *http.Request) bool {
+    referer := r.Header.Get("Referer")
+    if referer == "" {
+        referer = r.Header.Get("Origin")
+    }
+    if referer == "" {
+        return h.AllowEmpty
+    }
+    u, err := url.Parse(referer)
+    if err != nil {
+        return false
+    }
+    host := strings.ToLower(u.Host)
+    if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+        host = hostOnly
+    }
+    for _, domain := range h.AllowedDomains {
+        domain = strings.ToLower(domain)
+        if strings.HasPrefix(domain, "*.") {
+            if strings.HasSuffix(host, domain[1:]) {
+                return true
+            }
+        } else if host == domain {
+            return true
+        }
+    }
+    return false
+}
+
+// Applies the hotlink rules of the route a request belongs to.
+func withHotlinkProtection(pattern string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        route := config.routeForRequest(r, pattern)
+        if route == nil || route.Hotlink == nil || route.Hotlink.allows(r) {
+            handler(w, r)
+            return
+        }
+        hotlinkRejections.Inc(1)
+        log.Printf("Hotlink to %v from %q", r.URL, r.Header.Get("Referer"))
+        serveHotlinkAction(w, r, route.Hotlink)
+    }
+}
+
+// Sprites combine images of many routes, whose rules all have to allow r.
+// Returns the first route refusing it.
+func refusingRoute(r *http.Request, paths []string) *Route {
+    for _, path := range paths {
+        u, err := url.Parse(path)
+        if err != nil {
+            continue
+        }
+        route := config.routeFor(u.Path)
+        if route != nil && route.Hotlink != nil && !route.Hotlink.allows(r) {
+            return route
+        }
+    }
+    return nil
+}
+
+// The responses depend on the Referer, so they must not be cached for the
+// URL by anyone.
+func serveHotlinkAction(w http.ResponseWriter, r *http.Request, hotlink *Hotlink) {
+    w.Header().Set("Cache-Control", "no-store")
+    switch hotlink.Action {
+    case "redirect":
+        http.Redirect(w, r, hotlink.RedirectUrl, http.StatusFound)
+        return
+    case "placeholder":
+        u, _ := canonicalUrl(hotlink.Placeholder)
+        placeholder, _ := loadSource(u, nil)
+        if placeholder.StatusCode == 200 {
+            w.Header().Set("Content-Type", placeholder.ContentType)
+            w.Write(placeholder.Body)
+            return
+        }
+        log.Printf("Error loading hotlink placeholder %v: status %v", hotlink.Placeholder, placeholder.StatusCode)
+    }
+    http.Error(w, "hotlinking is not allowed", http.StatusForbidden)
+}
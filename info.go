@@ -0,0 +1,109 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "image"
+    "image/color"
+    "net/http"
+)
+
+const infoPathPrefix = "/_info"
+
+type ImageInfo struct {
+    Width int `json:"width"`
+    Height int `json:"height"`
+    Format string `json:"format"`
+    Bytes int `json:"bytes"`
+    Frames int `json:"frames"`
+    ColorModel string `json:"colorModel"`
+    HasAlpha bool `json:"hasAlpha"`
+    Orientation int `json:"orientation"`
+    CacheStatus string `json:"cacheStatus"`
+}
+
+// Describes the source image at the path following /_info, so clients can
+// lay out a page before downloading it.
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+    source, cached := loadSource(sourceUrlFor(r, infoPathPrefix), missBudgetFor(r))
+    if source.StatusCode != 200 {
+        serveResponse(*source, w)
+        return
+    }
+
+    cfg, format, err := image.DecodeConfig(bytes.NewReader(source.Body))
+    if err != nil {
+        http.Error(w, "cannot decode source image: " + err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+
+    info := ImageInfo{
+        Width: cfg.Width,
+        Height: cfg.Height,
+        Format: format,
+        Bytes: len(source.Body),
+        Frames: 1,
+        ColorModel: colorModelName(cfg.ColorModel),
+        HasAlpha: hasAlpha(cfg.ColorModel),
+        Orientation: source.Orientation,
+        CacheStatus: "miss",
+    }
+    if format == "gif" {
+        info.Frames = countGifFrames(source.Body)
+    }
+    if info.Orientation == 0 {
+        info.Orientation = 1
+    }
+    if cached {
+        info.CacheStatus = "hit"
+    }
+
+    body, err := json.Marshal(info)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(body)
+}
+
+func colorModelName(model color.Model) string {
+    if _, ok := model.(color.Palette); ok {
+        return "paletted"
+    }
+    switch model {
+    case color.RGBAModel:
+        return "rgba"
+    case color.RGBA64Model:
+        return "rgba64"
+    case color.NRGBAModel:
+        return "nrgba"
+    case color.NRGBA64Model:
+        return "nrgba64"
+    case color.GrayModel:
+        return "gray"
+    case color.Gray16Model:
+        return "gray16"
+    case color.YCbCrModel:
+        return "ycbcr"
+    case color.CMYKModel:
+        return "cmyk"
+    }
+    return "unknown"
+}
+
+func hasAlpha(model color.Model) bool {
+    if palette, ok := model.(color.Palette); ok {
+        for _, c := range palette {
+            if _, _, _, a := c.RGBA(); a != 0xffff {
+                return true
+            }
+        }
+        return false
+    }
+    switch model {
+    case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model:
+        return true
+    }
+    return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "log"
+    "net/http"
+)
+
+// Returned when an image is too large to be processed safely.
+type limitError struct {
+    reason string
+}
+
+func (e limitError) Error() string {
+    return "image rejected: " + e.reason
+}
+
+func rejectImage(format string, args ...interface{}) error {
+    err := limitError{fmt.Sprintf(format, args...)}
+    log.Println(err.Error())
+    imageRejections.Inc(1)
+    return err
+}
+
+func rejectedResponse(err error) ResponseData {
+    return ResponseData{
+        ContentType: "text/plain",
+        Body: []byte(err.Error()),
+        StatusCode: http.StatusUnprocessableEntity,
+    }
+}
+
+// Reads only the image header, so that images declaring huge dimensions are
+// refused before any pixel memory gets allocated.
+func checkImageLimits(body []byte) error {
+    if len(body) > maxInputBytes {
+        return rejectImage("%v bytes exceeds the limit of %v", len(body), maxInputBytes)
+    }
+    cfg, format, err := image.DecodeConfig(bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    if cfg.Width > maxInputDimension || cfg.Height > maxInputDimension {
+        return rejectImage("%vx%v exceeds the maximum dimension of %v", cfg.Width, cfg.Height, maxInputDimension)
+    }
+    if int64(cfg.Width)*int64(cfg.Height) > int64(maxInputPixels) {
+        return rejectImage("%vx%v exceeds the limit of %v pixels", cfg.Width, cfg.Height, maxInputPixels)
+    }
+    if format == "gif" {
+        frames := countGifFrames(body)
+        if frames > maxInputFrames {
+            return rejectImage("%v frames exceeds the limit of %v", frames, maxInputFrames)
+        }
+        // Every frame is rendered on the full logical screen.
+        total := int64(frames) * int64(cfg.Width) * int64(cfg.Height)
+        if total > int64(maxAnimationPixels) {
+            return rejectImage("%v frames of %vx%v exceed the limit of %v pixels", frames, cfg.Width, cfg.Height, maxAnimationPixels)
+        }
+    }
+    return nil
+}
+
+// Counts the image descriptors of a GIF by walking its block structure,
+// without decompressing any frame.
+func countGifFrames(body []byte) int {
+    if len(body) < 13 {
+        return 0
+    }
+    pos := 13
+    if body[10]&0x80 != 0 {
+        pos += 3 << (uint(body[10]&0x07) + 1)
+    }
+
+    frames := 0
+    skipSubBlocks := func() {
+        for pos < len(body) && body[pos] != 0 {
+            pos += int(body[pos]) + 1
+        }
+        pos++
+    }
+    for pos < len(body) {
+        switch body[pos] {
+        case 0x2C:
+            frames++
+            if pos+10 > len(body) {
+                return frames
+            }
+            packed := body[pos+9]
+            pos += 10
+            if packed&0x80 != 0 {
+                pos += 3 << (uint(packed&0x07) + 1)
+            }
+            pos++ // LZW minimum code size
+            skipSubBlocks()
+        case 0x21:
+            pos += 2
+            skipSubBlocks()
+        default:
+            return frames
+        }
+    }
+    return frames
+}
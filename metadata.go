@@ -0,0 +1,440 @@
+package main
+
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/binary"
+    "hash/crc32"
+    "io/ioutil"
+)
+
+// Metadata read from an origin image before it gets stripped.
+type imageMeta struct {
+    Orientation int
+    ICCProfile []byte
+    Copyright string
+    Artist string
+}
+
+const (
+    tagArtist = 0x013B
+    tagOrientation = 0x0112
+    tagCopyright = 0x8298
+)
+
+var (
+    exifHeader = []byte("Exif\x00\x00")
+    iccHeader = []byte("ICC_PROFILE\x00")
+    pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+func readMetadata(format string, body []byte) imageMeta {
+    switch format {
+    case "jpeg":
+        return readJpegMetadata(body)
+    case "png":
+        return readPngMetadata(body)
+    }
+    return imageMeta{}
+}
+
+// Removes EXIF, XMP, IPTC, ICC and comment data, leaving only what is
+// needed to decode the pixels.
+func stripMetadata(format string, body []byte) []byte {
+    switch format {
+    case "jpeg":
+        return stripJpegMetadata(body)
+    case "png":
+        return stripPngMetadata(body)
+    }
+    return body
+}
+
+// Re-inserts the parts of meta that the configuration asks us to keep.
+func embedMetadata(format string, body []byte, meta imageMeta) []byte {
+    var icc []byte
+    if keepIccProfile {
+        icc = meta.ICCProfile
+    }
+    var copyright, artist string
+    if keepCopyright {
+        copyright, artist = meta.Copyright, meta.Artist
+    }
+
+    switch format {
+    case "jpeg":
+        return embedJpegMetadata(body, icc, copyright, artist)
+    case "png":
+        return embedPngMetadata(body, icc, copyright, artist)
+    }
+    return body
+}
+
+// JPEG
+
+type jpegSegment struct {
+    marker byte
+    data []byte // payload without marker and length
+}
+
+// Splits a JPEG into its header segments and the remaining scan data
+// (starting at the SOS marker). Returns ok=false for anything malformed.
+func splitJpeg(body []byte) (segments []jpegSegment, rest []byte, ok bool) {
+    if len(body) < 4 || body[0] != 0xFF || body[1] != 0xD8 {
+        return nil, nil, false
+    }
+    pos := 2
+    for pos+4 <= len(body) {
+        if body[pos] != 0xFF {
+            return nil, nil, false
+        }
+        marker := body[pos+1]
+        if marker == 0xFF {
+            pos++ // fill byte
+            continue
+        }
+        if marker == 0xDA || marker == 0xD9 {
+            return segments, body[pos:], true
+        }
+        length := int(binary.BigEndian.Uint16(body[pos+2:]))
+        if length < 2 || pos+2+length > len(body) {
+            return nil, nil, false
+        }
+        segments = append(segments, jpegSegment{marker, body[pos+4 : pos+2+length]})
+        pos += 2 + length
+    }
+    return nil, nil, false
+}
+
+func joinJpeg(segments []jpegSegment, rest []byte) []byte {
+    var buf bytes.Buffer
+    buf.Write([]byte{0xFF, 0xD8})
+    for _, s := range segments {
+        writeJpegSegment(&buf, s.marker, s.data)
+    }
+    buf.Write(rest)
+    return buf.Bytes()
+}
+
+func writeJpegSegment(buf *bytes.Buffer, marker byte, data []byte) {
+    buf.Write([]byte{0xFF, marker})
+    binary.Write(buf, binary.BigEndian, uint16(len(data)+2))
+    buf.Write(data)
+}
+
+func readJpegMetadata(body []byte) imageMeta {
+    meta := imageMeta{Orientation: 1}
+    segments, _, ok := splitJpeg(body)
+    if !ok {
+        return meta
+    }
+
+    var iccChunks [][]byte
+    for _, s := range segments {
+        switch {
+        case s.marker == 0xE1 && bytes.HasPrefix(s.data, exifHeader):
+            readExif(s.data[len(exifHeader):], &meta)
+        case s.marker == 0xE2 && bytes.HasPrefix(s.data, iccHeader) && len(s.data) > len(iccHeader)+2:
+            seq := int(s.data[len(iccHeader)])
+            for len(iccChunks) < seq {
+                iccChunks = append(iccChunks, nil)
+            }
+            if seq > 0 {
+                iccChunks[seq-1] = s.data[len(iccHeader)+2:]
+            }
+        }
+    }
+    if len(iccChunks) > 0 {
+        meta.ICCProfile = bytes.Join(iccChunks, nil)
+    }
+    return meta
+}
+
+// Keeps JFIF (APP0), Adobe (APP14) and everything that is not an
+// application or comment segment.
+func stripJpegMetadata(body []byte) []byte {
+    segments, rest, ok := splitJpeg(body)
+    if !ok {
+        return body
+    }
+    kept := segments[:0]
+    for _, s := range segments {
+        isApp := s.marker >= 0xE0 && s.marker <= 0xEF
+        if s.marker == 0xFE || (isApp && s.marker != 0xE0 && s.marker != 0xEE) {
+            continue
+        }
+        kept = append(kept, s)
+    }
+    return joinJpeg(kept, rest)
+}
+
+const iccChunkSize = 65533 - 14 // segment limit minus ICC_PROFILE header
+
+func embedJpegMetadata(body []byte, icc []byte, copyright, artist string) []byte {
+    if len(icc) == 0 && copyright == "" && artist == "" {
+        return body
+    }
+    segments, rest, ok := splitJpeg(body)
+    if !ok {
+        return body
+    }
+
+    var extra []jpegSegment
+    if copyright != "" || artist != "" {
+        exif := append(append([]byte{}, exifHeader...), buildExif(copyright, artist)...)
+        extra = append(extra, jpegSegment{0xE1, exif})
+    }
+    count := (len(icc) + iccChunkSize - 1) / iccChunkSize
+    for i := 0; i < count && count < 256; i++ {
+        end := (i + 1) * iccChunkSize
+        if end > len(icc) {
+            end = len(icc)
+        }
+        chunk := append(append([]byte{}, iccHeader...), byte(i+1), byte(count))
+        extra = append(extra, jpegSegment{0xE2, append(chunk, icc[i*iccChunkSize:end]...)})
+    }
+
+    // JFIF requires APP0 to stay the first segment.
+    at := 0
+    if len(segments) > 0 && segments[0].marker == 0xE0 {
+        at = 1
+    }
+    result := append([]jpegSegment{}, segments[:at]...)
+    result = append(result, extra...)
+    result = append(result, segments[at:]...)
+    return joinJpeg(result, rest)
+}
+
+// EXIF / TIFF
+
+func readExif(tiff []byte, meta *imageMeta) {
+    if len(tiff) < 8 {
+        return
+    }
+    var order binary.ByteOrder
+    switch string(tiff[:2]) {
+    case "II":
+        order = binary.LittleEndian
+    case "MM":
+        order = binary.BigEndian
+    default:
+        return
+    }
+    ifd := int(order.Uint32(tiff[4:]))
+    if ifd < 8 || ifd+2 > len(tiff) {
+        return
+    }
+    count := int(order.Uint16(tiff[ifd:]))
+    for i := 0; i < count; i++ {
+        entry := ifd + 2 + i*12
+        if entry+12 > len(tiff) {
+            return
+        }
+        tag := order.Uint16(tiff[entry:])
+        typ := order.Uint16(tiff[entry+2:])
+        n := int(order.Uint32(tiff[entry+4:]))
+        switch {
+        case tag == tagOrientation && typ == 3:
+            meta.Orientation = int(order.Uint16(tiff[entry+8:]))
+        case tag == tagCopyright && typ == 2:
+            meta.Copyright = exifString(tiff, order, entry, n)
+        case tag == tagArtist && typ == 2:
+            meta.Artist = exifString(tiff, order, entry, n)
+        }
+    }
+    if meta.Orientation < 1 || meta.Orientation > 8 {
+        meta.Orientation = 1
+    }
+}
+
+func exifString(tiff []byte, order binary.ByteOrder, entry, n int) string {
+    var value []byte
+    if n <= 4 {
+        value = tiff[entry+8 : entry+8+n]
+    } else {
+        offset := int(order.Uint32(tiff[entry+8:]))
+        if offset < 0 || offset+n > len(tiff) {
+            return ""
+        }
+        value = tiff[offset : offset+n]
+    }
+    return string(bytes.TrimRight(value, "\x00 "))
+}
+
+// Builds a big-endian TIFF structure holding only the Artist and
+// Copyright tags.
+func buildExif(copyright, artist string) []byte {
+    type field struct {
+        tag uint16
+        value string
+    }
+    var fields []field
+    if artist != "" {
+        fields = append(fields, field{tagArtist, artist})
+    }
+    if copyright != "" {
+        fields = append(fields, field{tagCopyright, copyright})
+    }
+
+    var buf bytes.Buffer
+    buf.WriteString("MM\x00\x2A")
+    binary.Write(&buf, binary.BigEndian, uint32(8))
+    binary.Write(&buf, binary.BigEndian, uint16(len(fields)))
+
+    dataOffset := 8 + 2 + len(fields)*12 + 4
+    var data bytes.Buffer
+    for _, f := range fields {
+        value := append([]byte(f.value), 0)
+        binary.Write(&buf, binary.BigEndian, f.tag)
+        binary.Write(&buf, binary.BigEndian, uint16(2))
+        binary.Write(&buf, binary.BigEndian, uint32(len(value)))
+        if len(value) <= 4 {
+            buf.Write(append(value, make([]byte, 4-len(value))...))
+            continue
+        }
+        binary.Write(&buf, binary.BigEndian, uint32(dataOffset+data.Len()))
+        data.Write(value)
+        if data.Len()%2 == 1 {
+            data.WriteByte(0)
+        }
+    }
+    binary.Write(&buf, binary.BigEndian, uint32(0))
+    buf.Write(data.Bytes())
+    return buf.Bytes()
+}
+
+// PNG
+
+type pngChunk struct {
+    typ string
+    data []byte
+}
+
+func splitPng(body []byte) ([]pngChunk, bool) {
+    if !bytes.HasPrefix(body, pngSignature) {
+        return nil, false
+    }
+    var chunks []pngChunk
+    pos := len(pngSignature)
+    for pos+12 <= len(body) {
+        length := int(binary.BigEndian.Uint32(body[pos:]))
+        if length < 0 || pos+12+length > len(body) {
+            return nil, false
+        }
+        chunks = append(chunks, pngChunk{string(body[pos+4 : pos+8]), body[pos+8 : pos+8+length]})
+        pos += 12 + length
+    }
+    return chunks, len(chunks) > 0
+}
+
+func joinPng(chunks []pngChunk) []byte {
+    var buf bytes.Buffer
+    buf.Write(pngSignature)
+    for _, c := range chunks {
+        binary.Write(&buf, binary.BigEndian, uint32(len(c.data)))
+        crc := crc32.NewIEEE()
+        crc.Write([]byte(c.typ))
+        crc.Write(c.data)
+        buf.WriteString(c.typ)
+        buf.Write(c.data)
+        binary.Write(&buf, binary.BigEndian, crc.Sum32())
+    }
+    return buf.Bytes()
+}
+
+func readPngMetadata(body []byte) imageMeta {
+    meta := imageMeta{Orientation: 1}
+    chunks, ok := splitPng(body)
+    if !ok {
+        return meta
+    }
+    for _, c := range chunks {
+        switch c.typ {
+        case "eXIf":
+            readExif(c.data, &meta)
+        case "iCCP":
+            meta.ICCProfile = readIccpChunk(c.data)
+        case "tEXt":
+            keyword, value := splitTextChunk(c.data)
+            switch keyword {
+            case "Copyright":
+                meta.Copyright = value
+            case "Author":
+                meta.Artist = value
+            }
+        }
+    }
+    return meta
+}
+
+func readIccpChunk(data []byte) []byte {
+    nul := bytes.IndexByte(data, 0)
+    if nul < 0 || nul+2 > len(data) {
+        return nil
+    }
+    r, err := zlib.NewReader(bytes.NewReader(data[nul+2:]))
+    if err != nil {
+        return nil
+    }
+    defer r.Close()
+    profile, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil
+    }
+    return profile
+}
+
+func splitTextChunk(data []byte) (string, string) {
+    nul := bytes.IndexByte(data, 0)
+    if nul < 0 {
+        return "", ""
+    }
+    return string(data[:nul]), string(data[nul+1:])
+}
+
+var pngMetadataChunks = map[string]bool{
+    "eXIf": true, "iCCP": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+}
+
+func stripPngMetadata(body []byte) []byte {
+    chunks, ok := splitPng(body)
+    if !ok {
+        return body
+    }
+    kept := chunks[:0]
+    for _, c := range chunks {
+        if !pngMetadataChunks[c.typ] {
+            kept = append(kept, c)
+        }
+    }
+    return joinPng(kept)
+}
+
+func embedPngMetadata(body []byte, icc []byte, copyright, artist string) []byte {
+    if len(icc) == 0 && copyright == "" && artist == "" {
+        return body
+    }
+    chunks, ok := splitPng(body)
+    if !ok || chunks[0].typ != "IHDR" {
+        return body
+    }
+
+    var extra []pngChunk
+    if len(icc) > 0 {
+        var compressed bytes.Buffer
+        compressed.WriteString("ICC Profile\x00\x00")
+        w := zlib.NewWriter(&compressed)
+        w.Write(icc)
+        w.Close()
+        extra = append(extra, pngChunk{"iCCP", compressed.Bytes()})
+    }
+    if copyright != "" {
+        extra = append(extra, pngChunk{"tEXt", []byte("Copyright\x00" + copyright)})
+    }
+    if artist != "" {
+        extra = append(extra, pngChunk{"tEXt", []byte("Author\x00" + artist)})
+    }
+
+    result := append([]pngChunk{chunks[0]}, extra...)
+    return joinPng(append(result, chunks[1:]...))
+}
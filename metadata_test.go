@@ -0,0 +1,118 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+type exifEntryForTest struct {
+    tag, typ uint16
+    count, value uint32
+}
+
+// A little-endian TIFF with one IFD at offset 8, followed by extra.
+func tiffForTest(entries []exifEntryForTest, extra []byte) []byte {
+    var buf bytes.Buffer
+    buf.WriteString("II\x2A\x00")
+    binary.Write(&buf, binary.LittleEndian, uint32(8))
+    binary.Write(&buf, binary.LittleEndian, uint16(len(entries)))
+    for _, e := range entries {
+        binary.Write(&buf, binary.LittleEndian, e)
+    }
+    binary.Write(&buf, binary.LittleEndian, uint32(0))
+    buf.Write(extra)
+    return buf.Bytes()
+}
+
+func TestReadExif(t *testing.T) {
+    // Strings longer than 4 bytes are stored after the IFD of one entry.
+    stringOffset := uint32(8 + 2 + 12 + 4)
+    tests := []struct {
+        name string
+        tiff []byte
+        want imageMeta
+    }{
+        {"empty", nil, imageMeta{}},
+        {"too short", []byte("II\x2A\x00"), imageMeta{}},
+        {"unknown byte order", []byte("XX\x2A\x00\x08\x00\x00\x00\x00\x00"), imageMeta{}},
+        {"ifd beyond the end", []byte("II\x2A\x00\xFF\x00\x00\x00"), imageMeta{}},
+        {"ifd inside the header", []byte("II\x2A\x00\x02\x00\x00\x00\x00\x00"), imageMeta{}},
+        {"ifd offset overflowing", []byte("II\x2A\x00\xFF\xFF\xFF\xFF"), imageMeta{}},
+        {"more entries than data", tiffForTest(nil, nil)[:8], imageMeta{}},
+        {"truncated entry", append([]byte("II\x2A\x00\x08\x00\x00\x00\x05\x00"), make([]byte, 20)...), imageMeta{}},
+        {"orientation", tiffForTest([]exifEntryForTest{{tagOrientation, 3, 1, 6}}, nil), imageMeta{Orientation: 6}},
+        {"orientation out of range", tiffForTest([]exifEntryForTest{{tagOrientation, 3, 1, 9}}, nil), imageMeta{Orientation: 1}},
+        {"orientation of the wrong type", tiffForTest([]exifEntryForTest{{tagOrientation, 4, 1, 6}}, nil), imageMeta{Orientation: 1}},
+        {"short string", tiffForTest([]exifEntryForTest{{tagArtist, 2, 3, 0x004241}}, nil), imageMeta{Orientation: 1, Artist: "AB"}},
+        {"long string", tiffForTest([]exifEntryForTest{{tagCopyright, 2, 6, stringOffset}}, []byte("(c) X\x00")), imageMeta{Orientation: 1, Copyright: "(c) X"}},
+        {"string beyond the end", tiffForTest([]exifEntryForTest{{tagCopyright, 2, 6, stringOffset + 1}}, []byte("(c) X\x00")), imageMeta{Orientation: 1}},
+        {"string length overflowing", tiffForTest([]exifEntryForTest{{tagCopyright, 2, 0xFFFFFFFF, stringOffset}}, []byte("(c) X\x00")), imageMeta{Orientation: 1}},
+        {"string offset overflowing", tiffForTest([]exifEntryForTest{{tagCopyright, 2, 6, 0xFFFFFFFF}}, nil), imageMeta{Orientation: 1}},
+    }
+    for _, test := range tests {
+        var meta imageMeta
+        readExif(test.tiff, &meta)
+        if meta.Orientation != test.want.Orientation || meta.Copyright != test.want.Copyright || meta.Artist != test.want.Artist {
+            t.Errorf("%v: readExif = %+v, want %+v", test.name, meta, test.want)
+        }
+    }
+}
+
+func TestReadExifRoundTrip(t *testing.T) {
+    var meta imageMeta
+    readExif(buildExif("(c) Someone", "Someone Else"), &meta)
+    if meta.Copyright != "(c) Someone" || meta.Artist != "Someone Else" {
+        t.Errorf("readExif(buildExif) = %+v", meta)
+    }
+}
+
+func TestSplitJpeg(t *testing.T) {
+    soi := []byte{0xFF, 0xD8}
+    app0 := []byte{0xFF, 0xE0, 0x00, 0x04, 'a', 'b'}
+    sos := []byte{0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02}
+    join := func(parts ...[]byte) []byte {
+        return bytes.Join(parts, nil)
+    }
+    tests := []struct {
+        name string
+        body []byte
+        ok bool
+        segments int
+    }{
+        {"empty", nil, false, 0},
+        {"only SOI", soi, false, 0},
+        {"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), false, 0},
+        {"no marker after SOI", join(soi, []byte{0x00, 0xE0, 0x00, 0x04, 'a', 'b'}, sos), false, 0},
+        {"segment beyond the end", join(soi, []byte{0xFF, 0xE0, 0x10, 0x00, 'a', 'b'}, sos), false, 0},
+        {"segment length below 2", join(soi, []byte{0xFF, 0xE0, 0x00, 0x01}, sos), false, 0},
+        {"no scan", join(soi, app0), false, 0},
+        {"truncated marker", join(soi, app0, []byte{0xFF}), false, 0},
+        {"fill bytes only", join(soi, []byte{0xFF, 0xFF, 0xFF, 0xFF}), false, 0},
+        {"minimal", join(soi, sos), true, 0},
+        {"segment and scan", join(soi, app0, sos), true, 1},
+        {"fill bytes before a marker", join(soi, []byte{0xFF, 0xFF}, app0, sos), true, 1},
+        {"empty image", join(soi, []byte{0xFF, 0xD9, 0x00, 0x00}), true, 0},
+    }
+    for _, test := range tests {
+        segments, _, ok := splitJpeg(test.body)
+        if ok != test.ok || len(segments) != test.segments {
+            t.Errorf("%v: splitJpeg = %v segments, ok=%v, want %v, ok=%v", test.name, len(segments), ok, test.segments, test.ok)
+        }
+    }
+}
+
+func TestReadJpegMetadataMalformed(t *testing.T) {
+    exif := append(append([]byte{}, exifHeader...), "MM\x00\x2A\xFF\xFF\xFF\xFF"...)
+    var body bytes.Buffer
+    body.Write([]byte{0xFF, 0xD8})
+    writeJpegSegment(&body, 0xE1, exif)
+    writeJpegSegment(&body, 0xE2, append(append([]byte{}, iccHeader...), 3, 1))
+    writeJpegSegment(&body, 0xE2, append(append([]byte{}, iccHeader...), 0, 1, 'x'))
+    body.Write([]byte{0xFF, 0xDA, 0x00, 0x02})
+
+    meta := readJpegMetadata(body.Bytes())
+    if meta.Orientation != 1 || meta.ICCProfile != nil {
+        t.Errorf("readJpegMetadata = %+v", meta)
+    }
+}
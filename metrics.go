@@ -0,0 +1,37 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+
+    "github.com/yvasiyarov/go-metrics"
+)
+
+var (
+    metricsRegistry = metrics.NewRegistry()
+    imageRejections = newCounter("images.rejected")
+)
+
+func newCounter(name string) metrics.Counter {
+    counter := metrics.NewCounter()
+    metricsRegistry.Register(name, counter)
+    return counter
+}
+
+func newGauge(name string) metrics.Gauge {
+    gauge := metrics.NewGauge()
+    metricsRegistry.Register(name, gauge)
+    return gauge
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+    dump, err := json.Marshal(metricsRegistry)
+    if err != nil {
+        log.Printf("Error serializing metrics: %v", err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(dump)
+}
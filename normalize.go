@@ -0,0 +1,56 @@
+package main
+
+import (
+    "log"
+)
+
+// Prepares an origin image for caching: the EXIF orientation is applied to
+// the pixels, colors are converted to sRGB unless the embedded profile is
+// kept, and privacy sensitive metadata is stripped. JPEG and PNG files that
+// need neither are rewritten losslessly. Images exceeding the
+// configured limits are replaced by a 422 response.
+func normalizeImage(data ResponseData) ResponseData {
+    if data.StatusCode != 200 {
+        return data
+    }
+    format := sniffFormat(data.Body)
+    if format == "" {
+        return data
+    }
+    err := checkImageLimits(data.Body)
+    if _, rejected := err.(limitError); rejected {
+        return rejectedResponse(err)
+    }
+    if format != "jpeg" && format != "png" {
+        return data
+    }
+
+    meta := readMetadata(format, data.Body)
+    body := stripMetadata(format, data.Body)
+    profile := profileToConvert(meta)
+
+    if meta.Orientation > 1 || profile != nil {
+        img, _, err := decodeImage(body)
+        if err != nil {
+            log.Printf("Error decoding image for normalization: %v", err)
+            return data
+        }
+        if profile != nil {
+            img = profile.toSRGB(img)
+            log.Printf("Converted colors from ICC profile %q to sRGB", profile.description)
+        }
+        img = applyOrientation(img, meta.Orientation)
+        body, err = encodeImage(img, format, defaultQuality)
+        if err != nil {
+            log.Printf("Error encoding normalized image: %v", err)
+            return data
+        }
+        if meta.Orientation > 1 {
+            log.Printf("Applied EXIF orientation=%v", meta.Orientation)
+        }
+    }
+
+    data.Body = embedMetadata(format, body, meta)
+    data.Orientation = meta.Orientation
+    return data
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "errors"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var (
+    errOriginBusy = errors.New("too many origin requests waiting")
+    originQueueDepth = newGauge("origin.queue")
+    originShed = newCounter("origin.shed")
+)
+
+// Caps the number of concurrent origin requests, in total and per origin
+// host. Requests over the cap wait in a queue of bounded length for at most
+// queueTimeout, anything beyond that is refused right away so a slow origin
+// does not pile up goroutines.
+type originLimiter struct {
+    global chan struct{} // nil if unlimited
+    perOrigin int
+    maxQueue int64
+    queueTimeout time.Duration
+    waiting int64
+    lock sync.Mutex
+    origins map[string]chan struct{}
+}
+
+// Reads ORIGIN_CONCURRENCY and ORIGIN_HOST_CONCURRENCY, both unlimited if
+// unset, ORIGIN_QUEUE and ORIGIN_QUEUE_TIMEOUT in milliseconds.
+func initOriginLimiter() *originLimiter {
+    limiter := &originLimiter{
+        perOrigin: intSetting("ORIGIN_HOST_CONCURRENCY", 0),
+        maxQueue: int64(intSetting("ORIGIN_QUEUE", 100)),
+        queueTimeout: time.Duration(intSetting("ORIGIN_QUEUE_TIMEOUT", 2000)) * time.Millisecond,
+        origins: map[string]chan struct{}{},
+    }
+    if global := intSetting("ORIGIN_CONCURRENCY", 0); global > 0 {
+        limiter.global = make(chan struct{}, global)
+    }
+    if limiter.global != nil || limiter.perOrigin > 0 {
+        log.Printf("Limiting origin requests to %v in total and %v per host, %v may wait",
+            cap(limiter.global), limiter.perOrigin, limiter.maxQueue)
+    }
+    return limiter
+}
+
+func (l *originLimiter) slots(origin string) chan struct{} {
+    if l.perOrigin <= 0 {
+        return nil
+    }
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    slots, ok := l.origins[origin]
+    if !ok {
+        slots = make(chan struct{}, l.perOrigin)
+        l.origins[origin] = slots
+    }
+    return slots
+}
+
+// Waits for a slot for a request to origin and returns the function that
+// frees it again, or errOriginBusy if the request has to be shed.
+func (l *originLimiter) acquire(origin string) (func(), error) {
+    // The host slot comes first, so a slow host waiting for its own slots
+    // does not hold global ones other hosts could use.
+    host := l.slots(origin)
+    if tryAcquire(host) {
+        if tryAcquire(l.global) {
+            return func() { release(l.global); release(host) }, nil
+        }
+        release(host)
+    }
+
+    depth := atomic.AddInt64(&l.waiting, 1)
+    originQueueDepth.Update(depth)
+    defer func() { originQueueDepth.Update(atomic.AddInt64(&l.waiting, -1)) }()
+    if depth > l.maxQueue {
+        originShed.Inc(1)
+        return nil, errOriginBusy
+    }
+
+    timeout := time.NewTimer(l.queueTimeout)
+    defer timeout.Stop()
+    if !waitAcquire(host, timeout.C) {
+        originShed.Inc(1)
+        return nil, errOriginBusy
+    }
+    if !waitAcquire(l.global, timeout.C) {
+        release(host)
+        originShed.Inc(1)
+        return nil, errOriginBusy
+    }
+    return func() { release(l.global); release(host) }, nil
+}
+
+// Nil channels stand for unlimited slots.
+func tryAcquire(slots chan struct{}) bool {
+    if slots == nil {
+        return true
+    }
+    select {
+    case slots <- struct{}{}:
+        return true
+    default:
+        return false
+    }
+}
+
+func waitAcquire(slots chan struct{}, timeout <-chan time.Time) bool {
+    if slots == nil {
+        return true
+    }
+    select {
+    case slots <- struct{}{}:
+        return true
+    case <-timeout:
+        return false
+    }
+}
+
+func release(slots chan struct{}) {
+    if slots != nil {
+        <-slots
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "image"
+    "net/http"
+)
+
+const lqipPathPrefix = "/_lqip"
+
+// Everything a client needs to show something while the image loads.
+type Placeholder struct {
+    BlurHash string `json:"blurhash"`
+    Lqip string `json:"lqip"`
+    DominantColor string `json:"dominantColor"`
+}
+
+// Serves the placeholder of the source image at the path following
+// /_lqip. It is computed once and cached next to the source.
+func handleLqip(w http.ResponseWriter, r *http.Request) {
+    sourceUrl := sourceUrlFor(r, lqipPathPrefix)
+    cacheKey := cacheKeyFor(sourceUrl) + "#lqip"
+    responseData := loadFromCache(cacheKey)
+    if responseData == nil {
+        source, _ := loadSource(sourceUrl, missBudgetFor(r))
+        if source.StatusCode != 200 {
+            serveResponse(*source, w)
+            return
+        }
+        placeholder, err := computePlaceholder(source.Body)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+            return
+        }
+        body, err := json.Marshal(placeholder)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        responseData = &ResponseData{
+            ContentType: "application/json",
+            Body: body,
+            StatusCode: 200,
+        }
+        cacheResponse(cacheKey, *responseData)
+    }
+
+    serveResponse(*responseData, w)
+}
+
+func computePlaceholder(body []byte) (Placeholder, error) {
+    img, _, err := decodeImage(body)
+    if err != nil {
+        return Placeholder{}, fmt.Errorf("cannot decode source image: %v", err)
+    }
+
+    // Everything below works on small versions of the image, the result is
+    // blurry anyway. Both fit into a box by their longer side, so narrow
+    // sources do not get tall.
+    w, h := fitInto(img.Bounds(), 32)
+    small := resample(img, w, h)
+    xComponents, yComponents := 4, 3
+    if small.Rect.Dy() > small.Rect.Dx() {
+        xComponents, yComponents = 3, 4
+    }
+
+    w, h = fitInto(small.Rect, 16)
+    tiny := resample(small, w, h)
+    format := "jpeg"
+    if !tiny.Opaque() {
+        format = "png"
+    }
+    encoded, err := encodeImage(tiny, format, 40)
+    if err != nil {
+        return Placeholder{}, err
+    }
+
+    return Placeholder{
+        BlurHash: encodeBlurHash(small, xComponents, yComponents),
+        Lqip: "data:image/" + format + ";base64," + base64.StdEncoding.EncodeToString(encoded),
+        DominantColor: dominantColor(small),
+    }, nil
+}
+
+// Returns the average color of the most populated bucket when the RGB
+// space is split into 16x16x16 buckets. Transparent pixels are ignored.
+func dominantColor(img *image.NRGBA) string {
+    type bucket struct {
+        count int
+        r, g, b int
+    }
+    buckets := map[int]*bucket{}
+    var best *bucket
+    for i := 0; i+3 < len(img.Pix); i += 4 {
+        if img.Pix[i+3] < 128 {
+            continue
+        }
+        r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+        key := r>>4<<8 | g>>4<<4 | b>>4
+        bk := buckets[key]
+        if bk == nil {
+            bk = &bucket{}
+            buckets[key] = bk
+        }
+        bk.count++
+        bk.r, bk.g, bk.b = bk.r+r, bk.g+g, bk.b+b
+        if best == nil || bk.count > best.count {
+            best = bk
+        }
+    }
+    if best == nil {
+        return "#000000"
+    }
+    return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
+
+// The size of b scaled down to fit into a size x size box.
+func fitInto(b image.Rectangle, size int) (int, int) {
+    w, h, _ := resizeTarget(b.Dx(), b.Dy(), Transform{Width: size, Height: size})
+    return w, h
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "context"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Refills at rate tokens per second up to burst. Not safe for concurrent
+// use, the rateLimiter guards it.
+type tokenBucket struct {
+    tokens float64
+    updated time.Time
+}
+
+type clientBudget struct {
+    hits tokenBucket
+    misses tokenBucket
+    authFailures tokenBucket
+}
+
+// Keeps a hit and a miss budget per client. Every request takes a token
+// from the hit budget, every origin fetch one from the miss budget, so
+// crawlers walking through uncached images are stopped long before those
+// hitting the cache. Failed authentication attempts take from a third
+// budget the size of the hit budget, they never get as far as the others.
+type rateLimiter struct {
+    hitRate, hitBurst float64
+    missRate, missBurst float64
+    lock sync.Mutex
+    clients map[string]*clientBudget
+}
+
+type missBudgetKey struct{}
+
+var rateLimitRejections = newCounter("ratelimit.rejected")
+
+// Reads the budgets in requests per minute from RATE_LIMIT_HITS and
+// RATE_LIMIT_MISSES, and how many may be made at once from
+// RATE_LIMIT_HITS_BURST and RATE_LIMIT_MISSES_BURST, which default to a
+// minute's worth. Rate limiting is off unless one of the budgets is set.
+func initRateLimiter() *rateLimiter {
+    hits := intSetting("RATE_LIMIT_HITS", 0)
+    misses := intSetting("RATE_LIMIT_MISSES", 0)
+    if hits <= 0 && misses <= 0 {
+        log.Println("No RATE_LIMIT_HITS or RATE_LIMIT_MISSES found - requests will not be rate limited!")
+        return nil
+    }
+    limiter := &rateLimiter{
+        hitRate: float64(hits) / 60,
+        hitBurst: float64(intSetting("RATE_LIMIT_HITS_BURST", hits)),
+        missRate: float64(misses) / 60,
+        missBurst: float64(intSetting("RATE_LIMIT_MISSES_BURST", misses)),
+        clients: map[string]*clientBudget{},
+    }
+    go limiter.forgetIdleClients()
+    log.Printf("Rate limiting clients to %v hits and %v misses per minute", hits, misses)
+    return limiter
+}
+
+// Takes a token if there is one, otherwise returns how long to wait for
+// it. A zero rate means unlimited.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) time.Duration {
+    wait := b.wait(rate, burst, now)
+    if rate > 0 && wait == 0 {
+        b.tokens--
+    }
+    return wait
+}
+
+// Returns how long to wait for a token, without taking it.
+func (b *tokenBucket) wait(rate, burst float64, now time.Time) time.Duration {
+    if rate <= 0 {
+        return 0
+    }
+    if b.updated.IsZero() {
+        b.tokens = burst
+    } else {
+        b.tokens = math.Min(burst, b.tokens + now.Sub(b.updated).Seconds() * rate)
+    }
+    b.updated = now
+    if b.tokens >= 1 {
+        return 0
+    }
+    return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (l *rateLimiter) budget(client string) *clientBudget {
+    budget, ok := l.clients[client]
+    if !ok {
+        budget = &clientBudget{}
+        l.clients[client] = budget
+    }
+    return budget
+}
+
+func (l *rateLimiter) takeHit(client string) time.Duration {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    return l.budget(client).hits.take(l.hitRate, l.hitBurst, time.Now())
+}
+
+func (l *rateLimiter) takeMiss(client string) time.Duration {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    return l.budget(client).misses.take(l.missRate, l.missBurst, time.Now())
+}
+
+func (l *rateLimiter) authFailureWait(client string) time.Duration {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    return l.budget(client).authFailures.wait(l.hitRate, l.hitBurst, time.Now())
+}
+
+func (l *rateLimiter) takeAuthFailure(client string) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    l.budget(client).authFailures.take(l.hitRate, l.hitBurst, time.Now())
+}
+
+// Clients whose buckets have been refilled completely are the same as new
+// ones, so they are dropped to bound the memory used.
+func (l *rateLimiter) forgetIdleClients() {
+    for range time.Tick(time.Minute) {
+        l.lock.Lock()
+        now := time.Now()
+        for client, budget := range l.clients {
+            if budget.hits.full(l.hitRate, l.hitBurst, now) && budget.misses.full(l.missRate, l.missBurst, now) &&
+                    budget.authFailures.full(l.hitRate, l.hitBurst, now) {
+                delete(l.clients, client)
+            }
+        }
+        l.lock.Unlock()
+    }
+}
+
+func (b *tokenBucket) full(rate, burst float64, now time.Time) bool {
+    return rate <= 0 || b.updated.IsZero() || b.tokens + now.Sub(b.updated).Seconds() * rate >= burst
+}
+
+// Identifies the client by its tenant if it authenticated, otherwise by
+// the API key header named in RATE_LIMIT_KEY_HEADER or its IP address. The
+// header is only believed from the gateways listed in TRUSTED_PROXIES,
+// anyone else could pick a fresh key for every request.
+func rateLimitClient(r *http.Request) string {
+    if tenant := tenantFor(r); tenant != nil {
+        return "tenant:" + tenant.name
+    }
+    if rateLimitKeyHeader != "" && isTrustedProxy(remoteIP(r)) {
+        if key := r.Header.Get(rateLimitKeyHeader); key != "" {
+            return "key:" + key
+        }
+    }
+    return "ip:" + clientIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+    ip, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return ip
+}
+
+// The address of the client. X-Forwarded-For is only followed through the
+// proxies listed in TRUSTED_PROXIES, as IPs or CIDR ranges, since anyone
+// else can put anything there.
+func clientIP(r *http.Request) string {
+    ip := remoteIP(r)
+    if !isTrustedProxy(ip) {
+        return ip
+    }
+    forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+    for i := len(forwarded) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(forwarded[i])
+        if hop == "" {
+            continue
+        }
+        ip = hop
+        if !isTrustedProxy(hop) {
+            break
+        }
+    }
+    return ip
+}
+
+func isTrustedProxy(ip string) bool {
+    parsed := net.ParseIP(ip)
+    if parsed == nil {
+        return false
+    }
+    for _, proxy := range trustedProxies {
+        if strings.Contains(proxy, "/") {
+            _, network, err := net.ParseCIDR(proxy)
+            if err == nil && network.Contains(parsed) {
+                return true
+            }
+        } else if parsed.Equal(net.ParseIP(proxy)) {
+            return true
+        }
+    }
+    return false
+}
+
+// Answers with 429 once the client used up its hit budget, and makes its
+// miss budget available to loadSource through the request context.
+func withRateLimit(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if rateLimit == nil {
+            handler(w, r)
+            return
+        }
+        client := rateLimitClient(r)
+        if wait := rateLimit.takeHit(client); wait > 0 {
+            serveResponse(rateLimitedResponse(client, wait), w)
+            return
+        }
+        handler(w, r.WithContext(context.WithValue(r.Context(), missBudgetKey{}, client)))
+    }
+}
+
+// Wraps authentication, which happens before withRateLimit knows who the
+// client is. Clients that failed to authenticate too often are answered
+// with 429 before their credentials are looked at, so API keys and
+// signatures cannot be guessed faster than the hit budget allows. Returns
+// false if r got answered, otherwise the function to call when
+// authentication failed.
+func checkAuthRateLimit(w http.ResponseWriter, r *http.Request) (func(), bool) {
+    if rateLimit == nil {
+        return func() {}, true
+    }
+    client := rateLimitClient(r)
+    if wait := rateLimit.authFailureWait(client); wait > 0 {
+        serveResponse(rateLimitedResponse(client, wait), w)
+        return nil, false
+    }
+    return func() { rateLimit.takeAuthFailure(client) }, true
+}
+
+// For passing to loadSource: takes a token from the miss budget of the
+// client making r and returns nil, or the 429 response if there is none
+// left. Nil if rate limiting is off.
+func missBudgetFor(r *http.Request) func() *ResponseData {
+    client, ok := r.Context().Value(missBudgetKey{}).(string)
+    if !ok {
+        return nil
+    }
+    return func() *ResponseData {
+        if wait := rateLimit.takeMiss(client); wait > 0 {
+            limited := rateLimitedResponse(client, wait)
+            return &limited
+        }
+        return nil
+    }
+}
+
+func rateLimitedResponse(client string, wait time.Duration) ResponseData {
+    rateLimitRejections.Inc(1)
+    log.Printf("Rate limited %v for %v", client, wait)
+    return ResponseData{
+        ContentType: "text/plain",
+        Body: []byte("Too many requests"),
+        StatusCode: http.StatusTooManyRequests,
+        RetryAfter: int(math.Ceil(wait.Seconds())),
+    }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "image"
+    "math"
+)
+
+// Catmull-Rom cubic, a good compromise between sharpness and ringing.
+const filterSupport = 2.0
+
+func filterKernel(x float64) float64 {
+    x = math.Abs(x)
+    switch {
+    case x < 1:
+        return (1.5*x-2.5)*x*x + 1
+    case x < 2:
+        return ((-0.5*x+2.5)*x-4)*x + 2
+    }
+    return 0
+}
+
+type filterWeights struct {
+    start int
+    values []float64
+}
+
+// Computes for every destination pixel which source pixels contribute to it
+// and how much. When downscaling the kernel is widened to avoid aliasing.
+func computeWeights(dstSize, srcSize int) []filterWeights {
+    scale := float64(srcSize) / float64(dstSize)
+    filterScale := math.Max(scale, 1)
+    radius := filterSupport * filterScale
+
+    weights := make([]filterWeights, dstSize)
+    for i := range weights {
+        center := (float64(i)+0.5)*scale - 0.5
+        start := int(math.Ceil(center - radius))
+        end := int(math.Floor(center + radius))
+        if start < 0 {
+            start = 0
+        }
+        if end > srcSize-1 {
+            end = srcSize - 1
+        }
+
+        values := make([]float64, end-start+1)
+        sum := 0.0
+        for j := range values {
+            values[j] = filterKernel((float64(start+j) - center) / filterScale)
+            sum += values[j]
+        }
+        if sum != 0 {
+            for j := range values {
+                values[j] /= sum
+            }
+        }
+        weights[i] = filterWeights{start, values}
+    }
+    return weights
+}
+
+// Scales img to exactly w x h pixels. Filtering is done on premultiplied
+// alpha so transparent pixels do not bleed their color into the result.
+func resample(img image.Image, w, h int) *image.NRGBA {
+    src := toNRGBA(img)
+    b := src.Bounds()
+    srcW, srcH := b.Dx(), b.Dy()
+    if srcW == w && srcH == h && b.Min == (image.Point{}) {
+        return src
+    }
+
+    // Horizontal pass into a premultiplied float buffer of w x srcH.
+    xWeights := computeWeights(w, srcW)
+    tmp := make([]float64, w*srcH*4)
+    for y := 0; y < srcH; y++ {
+        row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+        for x, wt := range xWeights {
+            var r, g, bl, a float64
+            for j, v := range wt.values {
+                p := row[(wt.start+j)*4:]
+                alpha := float64(p[3]) * v
+                r += float64(p[0]) * alpha
+                g += float64(p[1]) * alpha
+                bl += float64(p[2]) * alpha
+                a += alpha
+            }
+            o := (y*w + x) * 4
+            tmp[o], tmp[o+1], tmp[o+2], tmp[o+3] = r, g, bl, a
+        }
+    }
+
+    // Vertical pass back into straight alpha.
+    yWeights := computeWeights(h, srcH)
+    dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+    for y, wt := range yWeights {
+        for x := 0; x < w; x++ {
+            var r, g, bl, a float64
+            for j, v := range wt.values {
+                o := ((wt.start+j)*w + x) * 4
+                r += tmp[o] * v
+                g += tmp[o+1] * v
+                bl += tmp[o+2] * v
+                a += tmp[o+3] * v
+            }
+            d := dst.Pix[dst.PixOffset(x, y):]
+            if a <= 0 {
+                d[0], d[1], d[2], d[3] = 0, 0, 0, 0
+                continue
+            }
+            d[0] = clampByte(r / a)
+            d[1] = clampByte(g / a)
+            d[2] = clampByte(bl / a)
+            d[3] = clampByte(a)
+        }
+    }
+    return dst
+}
+
+func clampByte(v float64) uint8 {
+    switch {
+    case v <= 0:
+        return 0
+    case v >= 255:
+        return 255
+    }
+    return uint8(v + 0.5)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Query parameters carrying the signature of a URL and its optional expiry
+// as unix timestamp. The expiry is covered by the signature.
+const (
+    signatureParam = "s"
+    expiryParam = "exp"
+)
+
+type signingKey struct {
+    id string
+    secret []byte
+}
+
+// Reads SIGNING_KEYS=id1:secret1,id2:secret2. All keys are accepted when
+// verifying, so a new key can be rolled out before the old one is removed.
+// The first key signs the URLs we generate ourselves.
+func initSigningKeys() []signingKey {
+    setting := os.Getenv("SIGNING_KEYS")
+    if setting == "" {
+        log.Println("No SIGNING_KEYS found - URLs will not be verified!")
+        return nil
+    }
+    var keys []signingKey
+    var ids []string
+    for _, pair := range strings.Split(setting, ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+        if len(parts) != 2 || parts[1] == "" {
+            log.Fatalf("Error parsing SIGNING_KEYS: expected id:secret, got %q", pair)
+        }
+        keys = append(keys, signingKey{parts[0], []byte(parts[1])})
+        ids = append(ids, parts[0])
+    }
+    log.Printf("Verifying URL signatures with keys %v", strings.Join(ids, ", "))
+    return keys
+}
+
+// The signed message: the path followed by the sorted query without the
+// signature itself.
+func signaturePayload(path string, query url.Values) string {
+    rest := url.Values{}
+    for name, values := range query {
+        if name != signatureParam {
+            rest[name] = values
+        }
+    }
+    if len(rest) == 0 {
+        return path
+    }
+    return path + "?" + rest.Encode()
+}
+
+func computeSignature(key signingKey, payload string) string {
+    mac := hmac.New(sha256.New, key.secret)
+    mac.Write([]byte(payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Appends a signature made with the first key to a path with optional
+// query, for URLs we hand out in response to r. URLs for a tenant are
+// signed with its first API key instead. They expire with r, a short-lived
+// URL must not hand out lasting ones. Unchanged when signing is off.
+func signUrl(rawUrl string, r *http.Request) string {
+    tenant := tenantFor(r)
+    key := signingKey{}
+    if tenant != nil {
+        key = signingKey{tenant.Keys[0].Id, []byte(tenant.Keys[0].Secret)}
+    } else if len(signingKeys) > 0 {
+        key = signingKeys[0]
+    } else {
+        return rawUrl
+    }
+    u, err := url.Parse(rawUrl)
+    if err != nil {
+        return rawUrl
+    }
+    query := u.Query()
+    if tenant != nil {
+        query.Set(apiKeyParam, key.id)
+    }
+    // The handlers only see the URL without the signature parameters.
+    if exp := receivedUrl(r).Query().Get(expiryParam); exp != "" {
+        query.Set(expiryParam, exp)
+    }
+    query.Set(signatureParam, computeSignature(key, signaturePayload(u.Path, query)))
+    u.RawQuery = query.Encode()
+    return u.String()
+}
+
+func verifySignature(u *url.URL) bool {
+    return verifySignatureWith(u, signingKeys)
+}
+
+func verifySignatureWith(u *url.URL, keys []signingKey) bool {
+    query := u.Query()
+    signature := query.Get(signatureParam)
+    if signature == "" {
+        return false
+    }
+    if exp := query.Get(expiryParam); exp != "" {
+        expires, err := strconv.ParseInt(exp, 10, 64)
+        if err != nil || time.Now().Unix() > expires {
+            return false
+        }
+    }
+    payload := signaturePayload(u.Path, query)
+    for _, key := range keys {
+        if hmac.Equal([]byte(signature), []byte(computeSignature(key, payload))) {
+            return true
+        }
+    }
+    return false
+}
+
+// Rejects requests without a valid signature before they reach the cache
+// or origin, and removes the signature parameters so they do not end up in
+// cache keys or origin URLs. Tenants have been authenticated by their own
+// keys already.
+func requireSignature(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if len(signingKeys) == 0 || tenantFor(r) != nil {
+            handler(w, r)
+            return
+        }
+        if !verifySignature(receivedUrl(r)) {
+            log.Printf("Invalid signature for %v", r.URL)
+            http.Error(w, "invalid or expired signature", http.StatusForbidden)
+            return
+        }
+        query := r.URL.Query()
+        query.Del(signatureParam)
+        query.Del(expiryParam)
+        r.URL.RawQuery = query.Encode()
+        handler(w, r)
+    }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "net/http/httptest"
+    "net/url"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func signedForTest(t *testing.T, key signingKey, rawUrl string) string {
+    u, err := url.Parse(rawUrl)
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := u.Query()
+    query.Set(signatureParam, computeSignature(key, signaturePayload(u.Path, query)))
+    u.RawQuery = query.Encode()
+    return u.String()
+}
+
+func TestVerifySignatureWith(t *testing.T) {
+    current := signingKey{"k2", []byte("current secret")}
+    previous := signingKey{"k1", []byte("previous secret")}
+    other := signingKey{"x", []byte("someone else")}
+    keys := []signingKey{current, previous}
+    future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+    past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+    tests := []struct {
+        name string
+        url string
+        valid bool
+    }{
+        {"current key", signedForTest(t, current, "/a.jpg?w=100"), true},
+        {"previous key during rotation", signedForTest(t, previous, "/a.jpg?w=100"), true},
+        {"unknown key", signedForTest(t, other, "/a.jpg?w=100"), false},
+        {"no query", signedForTest(t, current, "/a.jpg"), true},
+        {"query order does not matter", signedForTest(t, current, "/a.jpg?w=100&h=50") + "&", true},
+        {"missing signature", "/a.jpg?w=100", false},
+        {"empty signature", "/a.jpg?w=100&s=", false},
+        {"tampered query", signedForTest(t, current, "/a.jpg?w=100") + "&h=5000", false},
+        {"tampered value", replaceParam(t, signedForTest(t, current, "/a.jpg?w=100"), "w", "5000"), false},
+        {"tampered path", replacePath(t, signedForTest(t, current, "/a.jpg?w=100"), "/b.jpg"), false},
+        {"not expired", signedForTest(t, current, "/a.jpg?exp=" + future), true},
+        {"expired", signedForTest(t, current, "/a.jpg?exp=" + past), false},
+        {"extended expiry", replaceParam(t, signedForTest(t, current, "/a.jpg?exp=" + past), "exp", future), false},
+        {"invalid expiry", signedForTest(t, current, "/a.jpg?exp=soon"), false},
+    }
+    for _, test := range tests {
+        u, err := url.Parse(test.url)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if valid := verifySignatureWith(u, keys); valid != test.valid {
+            t.Errorf("%v: verifySignatureWith(%v) = %v, want %v", test.name, test.url, valid, test.valid)
+        }
+    }
+}
+
+func TestVerifySignatureWithoutKeys(t *testing.T) {
+    key := signingKey{"k", []byte("secret")}
+    u, _ := url.Parse(signedForTest(t, key, "/a.jpg"))
+    if verifySignatureWith(u, nil) {
+        t.Error("signature verified without any keys")
+    }
+}
+
+func TestSignUrlKeepsExpiry(t *testing.T) {
+    defer func(previous []signingKey) { signingKeys = previous }(signingKeys)
+    signingKeys = []signingKey{{"k", []byte("secret")}}
+    future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+    r := httptest.NewRequest("GET", "/a.jpg?w=100", nil)
+    received, _ := url.Parse("/a.jpg?w=100&exp=" + future + "&s=x")
+    r = r.WithContext(context.WithValue(r.Context(), receivedUrlKey{}, received))
+
+    u, _ := url.Parse(signUrl("/a.jpg?w=50", r))
+    if u.Query().Get(expiryParam) != future {
+        t.Errorf("signUrl = %v, want exp=%v", u, future)
+    }
+    if !verifySignatureWith(u, signingKeys) {
+        t.Errorf("signUrl = %v does not verify", u)
+    }
+}
+
+func replaceParam(t *testing.T, rawUrl, name, value string) string {
+    u, err := url.Parse(rawUrl)
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := u.Query()
+    query.Set(name, value)
+    u.RawQuery = query.Encode()
+    return u.String()
+}
+
+func replacePath(t *testing.T, rawUrl, path string) string {
+    u, err := url.Parse(rawUrl)
+    if err != nil {
+        t.Fatal(err)
+    }
+    u.Path = path
+    return u.String()
+}
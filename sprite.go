@@ -0,0 +1,268 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "image/draw"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+const (
+    spritePath = "/_sprite"
+    spriteMapPath = "/_sprite.json"
+    maxSpriteTiles = 256
+    maxSpriteTileSize = 512
+    // Each side of the sheet, which is composed in memory as a whole.
+    maxSpriteSize = 4096
+)
+
+// A sheet of equally sized tiles, one per source image, laid out in rows.
+type Sprite struct {
+    Paths []string
+    TileWidth int
+    TileHeight int
+    Columns int
+    Fit string
+    Format string
+    // Cache namespace of the tenant the sources belong to.
+    Namespace string
+}
+
+type SpriteTile struct {
+    Path string `json:"path"`
+    X int `json:"x"`
+    Y int `json:"y"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+}
+
+type SpriteMap struct {
+    Image string `json:"image"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+    Tiles []SpriteTile `json:"tiles"`
+}
+
+// Parses the sprite of a request to either sprite endpoint.
+func spriteFor(r *http.Request) (Sprite, error) {
+    if tenant := tenantFor(r); tenant != nil && len(tenant.Presets) > 0 {
+        // Tiles are sized ad-hoc, which such tenants may not do.
+        return Sprite{}, errors.New("only presets are allowed")
+    }
+    return parseSprite(r.URL.Query())
+}
+
+// Parses ?path=/a.jpg&path=/b.jpg&tile=64x64[&cols=10][&fit=contain][&fm=jpeg].
+func parseSprite(query url.Values) (Sprite, error) {
+    if config.PresetsOnly {
+        // Tiles are sized ad-hoc.
+        return Sprite{}, errors.New("only presets are allowed")
+    }
+    sprite := Sprite{
+        Paths: query["path"],
+        Fit: query.Get("fit"),
+        Format: query.Get("fm"),
+    }
+    if len(sprite.Paths) == 0 {
+        return sprite, errors.New("missing path")
+    }
+    if len(sprite.Paths) > maxSpriteTiles {
+        return sprite, fmt.Errorf("at most %v paths are allowed", maxSpriteTiles)
+    }
+    for i, path := range sprite.Paths {
+        if !strings.HasPrefix(path, "/") {
+            return sprite, fmt.Errorf("path %q must start with /", path)
+        }
+        u, err := canonicalUrl(path)
+        if err != nil {
+            return sprite, fmt.Errorf("path %q: %v", path, err)
+        }
+        sprite.Paths[i] = u.String()
+    }
+
+    size := strings.SplitN(query.Get("tile"), "x", 2)
+    var err1, err2 error
+    sprite.TileWidth, err1 = strconv.Atoi(size[0])
+    sprite.TileHeight = sprite.TileWidth
+    if len(size) == 2 {
+        sprite.TileHeight, err2 = strconv.Atoi(size[1])
+    }
+    if err1 != nil || err2 != nil || sprite.TileWidth <= 0 || sprite.TileHeight <= 0 ||
+        sprite.TileWidth > maxSpriteTileSize || sprite.TileHeight > maxSpriteTileSize {
+        return sprite, fmt.Errorf("tile must be WIDTHxHEIGHT up to %v pixels", maxSpriteTileSize)
+    }
+
+    sprite.Columns = len(sprite.Paths)
+    if cols := query.Get("cols"); cols != "" {
+        n, err := strconv.Atoi(cols)
+        if err != nil || n <= 0 {
+            return sprite, fmt.Errorf("invalid cols=%q", cols)
+        }
+        sprite.Columns = n
+    }
+    if sprite.Columns > len(sprite.Paths) {
+        sprite.Columns = len(sprite.Paths)
+    }
+    if sprite.Fit == "" {
+        sprite.Fit = "cover"
+    }
+    if sprite.Format == "" {
+        sprite.Format = "png"
+    }
+
+    width, height := sprite.size()
+    if width > maxSpriteSize || height > maxSpriteSize {
+        return sprite, fmt.Errorf("sprite of %vx%v exceeds %vx%v pixels", width, height, maxSpriteSize, maxSpriteSize)
+    }
+    return sprite, Transform{Fit: sprite.Fit, Format: sprite.Format}.validate()
+}
+
+func (s Sprite) size() (int, int) {
+    rows := (len(s.Paths) + s.Columns - 1) / s.Columns
+    return s.Columns * s.TileWidth, rows * s.TileHeight
+}
+
+func (s Sprite) tileAt(i int) image.Rectangle {
+    x, y := (i%s.Columns)*s.TileWidth, (i/s.Columns)*s.TileHeight
+    return image.Rect(x, y, x+s.TileWidth, y+s.TileHeight)
+}
+
+// Cache key covering every input of the composite.
+func (s Sprite) key() string {
+    hash := sha256.New()
+    fmt.Fprintf(hash, "%v,%vx%v,%v,%v,%v\n", s.Namespace, s.TileWidth, s.TileHeight, s.Columns, s.Fit, s.Format)
+    hash.Write([]byte(strings.Join(s.Paths, "\n")))
+    key := "sprite:" + hex.EncodeToString(hash.Sum(nil))
+    if s.Namespace != "" {
+        // Stored with the tenant's other entries, see memcachedKey.
+        return namespaceKeyPrefix + s.Namespace + "|" + key
+    }
+    return key
+}
+
+// Serves the coordinate map of a sprite. It only depends on the request,
+// so no image has to be loaded for it.
+func handleSpriteMap(w http.ResponseWriter, r *http.Request) {
+    sprite, err := spriteFor(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    spriteMap := SpriteMap{Image: signUrl(spritePath + "?" + r.URL.RawQuery, r)}
+    spriteMap.Width, spriteMap.Height = sprite.size()
+    for i, path := range sprite.Paths {
+        tile := sprite.tileAt(i)
+        spriteMap.Tiles = append(spriteMap.Tiles, SpriteTile{path, tile.Min.X, tile.Min.Y, tile.Dx(), tile.Dy()})
+    }
+
+    body, err := json.Marshal(spriteMap)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    serveResponse(ResponseData{ContentType: "application/json", Body: body, StatusCode: 200}, w)
+}
+
+// Serves the sprite image, composed from the cached sources on a miss.
+func handleSprite(w http.ResponseWriter, r *http.Request) {
+    sprite, err := spriteFor(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if route := refusingRoute(r, sprite.Paths); route != nil {
+        hotlinkRejections.Inc(1)
+        log.Printf("Hotlink to sprite with %v tiles from %q", route.Prefix, r.Header.Get("Referer"))
+        // Other actions make no sense for a single tile.
+        serveHotlinkAction(w, r, &Hotlink{Action: "deny"})
+        return
+    }
+    sprite.Namespace = r.URL.Host
+
+    cacheKey := sprite.key()
+    responseData := loadFromCache(cacheKey)
+    if responseData == nil {
+        fmt.Println("Composing sprite: ", cacheKey)
+        composed, err := composeSprite(sprite, missBudgetFor(r))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+            return
+        }
+        if composed.StatusCode != 200 {
+            serveResponse(composed, w)
+            return
+        }
+        cacheResponse(cacheKey, composed)
+        responseData = &composed
+    }
+    serveResponse(*responseData, w)
+}
+
+// Tiles whose source cannot be loaded stay transparent, one broken image
+// should not break the whole page. A rate limited client gets the 429
+// response instead of an incomplete sprite. Tiles are watermarked like the
+// variants of their route.
+func composeSprite(sprite Sprite, budget func() *ResponseData) (ResponseData, error) {
+    width, height := sprite.size()
+    sheet := image.NewNRGBA(image.Rect(0, 0, width, height))
+    pipelines := map[string]*pixelPipeline{}
+
+    for i, path := range sprite.Paths {
+        u, err := url.Parse(path)
+        if err != nil {
+            log.Printf("Skipping sprite tile %v: %v", path, err)
+            continue
+        }
+        u.Host = sprite.Namespace
+        source, _ := loadSource(u, budget)
+        if source.StatusCode == http.StatusTooManyRequests {
+            return *source, nil
+        }
+        if source.StatusCode != 200 {
+            log.Printf("Skipping sprite tile %v: status %v", path, source.StatusCode)
+            continue
+        }
+        img, _, err := decodeImage(source.Body)
+        if err != nil {
+            log.Printf("Skipping sprite tile %v: %v", path, err)
+            continue
+        }
+
+        tile := Transform{Width: sprite.TileWidth, Height: sprite.TileHeight, Fit: sprite.Fit}
+        if route := config.routeFor(u.Path); route != nil {
+            tile.Watermark = route.Watermark
+        }
+        pipeline, ok := pipelines[tile.Watermark]
+        if !ok {
+            if pipeline, err = newPixelPipeline(tile); err != nil {
+                return ResponseData{}, err
+            }
+            pipelines[tile.Watermark] = pipeline
+        }
+
+        img = pipeline.apply(img)
+        cell := sprite.tileAt(i)
+        b := img.Bounds()
+        at := cell.Min.Add(image.Pt((cell.Dx()-b.Dx())/2, (cell.Dy()-b.Dy())/2))
+        draw.Draw(sheet, b.Sub(b.Min).Add(at), img, b.Min, draw.Src)
+    }
+
+    body, err := encodeImage(sheet, sprite.Format, defaultQuality)
+    if err != nil {
+        return ResponseData{}, fmt.Errorf("cannot encode sprite: %v", err)
+    }
+    return ResponseData{
+        ContentType: "image/" + sprite.Format,
+        Body: body,
+        StatusCode: 200,
+    }, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "net/url"
+    "strings"
+    "testing"
+)
+
+func TestParseSpriteLimits(t *testing.T) {
+    paths := func(n int) string {
+        return strings.Repeat("path=/a.jpg&", n)
+    }
+    tests := []struct {
+        query string
+        ok bool
+    }{
+        {paths(2) + "tile=64", true},
+        {paths(2) + "tile=64x32&cols=1", true},
+        {"tile=64", false},
+        {paths(1) + "tile=a.jpg", false},
+        {paths(1) + "tile=513", false},
+        {"path=a.jpg&tile=64", false},
+        {"path=/../a.jpg&tile=64", false},
+        {paths(maxSpriteTiles) + "tile=16", true},
+        {paths(maxSpriteTiles + 1) + "tile=16", false},
+        {paths(8) + "tile=512", true},
+        {paths(9) + "tile=512", false},
+        {paths(9) + "tile=512&cols=3", true},
+        {paths(1) + "tile=64&fm=tiff", false},
+    }
+    for _, test := range tests {
+        query, err := url.ParseQuery(test.query)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := parseSprite(query); (err == nil) != test.ok {
+            t.Errorf("parseSprite(%.80v) = %v, want ok=%v", test.query, err, test.ok)
+        }
+    }
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "html"
+    "log"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+const (
+    srcsetPathPrefix = "/_srcset"
+    maxSrcsetWidths = 20
+)
+
+// Query parameters of the srcset endpoint itself, everything else is
+// passed on to the variant URLs.
+var srcsetParams = []string{"widths", "family", "sizes", "warm"}
+
+type SrcsetVariant struct {
+    Width int `json:"width"`
+    Url string `json:"url"`
+}
+
+type Srcset struct {
+    Srcset string `json:"srcset"`
+    Sizes string `json:"sizes"`
+    // Both attributes, ready to be put into an <img> tag.
+    Attributes string `json:"attributes"`
+    Variants []SrcsetVariant `json:"variants"`
+}
+
+// Lists the variant URLs for the image at the path following /_srcset,
+// either for ?widths=320,640,1280 or for the presets of ?family=<name>.
+// With ?warm=1 the variants are rendered into the cache in the background.
+func handleSrcset(w http.ResponseWriter, r *http.Request) {
+    sourceUrl := sourceUrlFor(r, srcsetPathPrefix)
+    query := sourceUrl.Query()
+    for _, name := range srcsetParams {
+        query.Del(name)
+    }
+
+    var variants []SrcsetVariant
+    var err error
+    if family := r.URL.Query().Get("family"); family != "" {
+        variants, err = familyVariants(sourceUrl.Path, query, family)
+    } else {
+        variants, err = widthVariants(sourceUrl.Path, query, r.URL.Query().Get("widths"))
+    }
+    if err == nil {
+        err = checkTenantVariants(tenantFor(r), variants)
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    sizes := r.URL.Query().Get("sizes")
+    if sizes == "" {
+        sizes = "100vw"
+    }
+    if boolParam(r.URL.Query(), "warm", false) {
+        go warmVariants(variants, sourceUrl.Host, missBudgetFor(r))
+    }
+
+    // The warmer gets the unsigned URLs, only clients need signatures.
+    signed := make([]SrcsetVariant, len(variants))
+    var candidates []string
+    for i, v := range variants {
+        v.Url = signUrl(v.Url, r)
+        signed[i] = v
+        candidates = append(candidates, fmt.Sprintf("%v %vw", v.Url, v.Width))
+    }
+    srcset := Srcset{
+        Srcset: strings.Join(candidates, ", "),
+        Sizes: sizes,
+        Variants: signed,
+    }
+    srcset.Attributes = fmt.Sprintf(`srcset="%v" sizes="%v"`, html.EscapeString(srcset.Srcset), html.EscapeString(sizes))
+
+    body, err := json.Marshal(srcset)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(body)
+}
+
+func widthVariants(path string, query url.Values, param string) ([]SrcsetVariant, error) {
+    if config.PresetsOnly {
+        return nil, errors.New("only presets are allowed, use ?family=")
+    }
+    if param == "" {
+        return nil, errors.New("missing widths or family")
+    }
+
+    var widths []int
+    for _, value := range strings.Split(param, ",") {
+        width, err := strconv.Atoi(strings.TrimSpace(value))
+        if err != nil || width <= 0 || width > maxDimension {
+            return nil, fmt.Errorf("invalid width %q", value)
+        }
+        widths = append(widths, width)
+    }
+    if len(widths) > maxSrcsetWidths {
+        return nil, fmt.Errorf("at most %v widths are allowed", maxSrcsetWidths)
+    }
+    sort.Ints(widths)
+
+    var variants []SrcsetVariant
+    for _, width := range widths {
+        query.Set("w", strconv.Itoa(width))
+        u := &url.URL{Path: path, RawQuery: query.Encode()}
+        variants = append(variants, SrcsetVariant{width, u.String()})
+    }
+    return variants, nil
+}
+
+func familyVariants(path string, query url.Values, family string) ([]SrcsetVariant, error) {
+    presets, ok := config.PresetFamilies[family]
+    if !ok {
+        return nil, fmt.Errorf("unknown preset family %q", family)
+    }
+
+    var variants []SrcsetVariant
+    for _, name := range presets {
+        u := &url.URL{Path: presetPathPrefix + name + path, RawQuery: query.Encode()}
+        variants = append(variants, SrcsetVariant{config.Presets[name].Width, u.String()})
+    }
+    sort.Slice(variants, func(i, j int) bool { return variants[i].Width < variants[j].Width })
+    return variants, nil
+}
+
+// Holds the variants to the same presets as the tenant's own requests, so
+// they can neither be listed nor warmed otherwise.
+func checkTenantVariants(tenant *Tenant, variants []SrcsetVariant) error {
+    if tenant == nil {
+        return nil
+    }
+    for _, v := range variants {
+        u, err := url.Parse(v.Url)
+        if err != nil {
+            return err
+        }
+        if err := tenant.checkPresets(u); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Renders the variants one after another, exactly as if they had been
+// requested by the client with the given cache namespace and miss budget.
+func warmVariants(variants []SrcsetVariant, namespace string, budget func() *ResponseData) {
+    for _, v := range variants {
+        u, err := url.Parse(v.Url)
+        if err != nil {
+            log.Printf("Error warming %v: %v", v.Url, err)
+            continue
+        }
+        u.Host = namespace
+        transform, sourceUrl, err := parseTransform(u)
+        if err != nil {
+            log.Printf("Error warming %v: %v", v.Url, err)
+            continue
+        }
+        variant, err := loadVariant(sourceUrl, transform, budget)
+        if err != nil {
+            log.Printf("Error warming %v: %v", v.Url, err)
+            continue
+        }
+        if variant.StatusCode != 200 {
+            log.Printf("Error warming %v: status %v", v.Url, variant.StatusCode)
+            continue
+        }
+        log.Printf("Warmed variant %v", v.Url)
+    }
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+    "bytes"
+    "encoding/xml"
+    "errors"
+    "io"
+    "regexp"
+    "strings"
+)
+
+// Elements needed to render static and animated SVG, lowercased. Anything
+// else, like script, foreignObject and style, is dropped together with its
+// content.
+var svgElements = setOf(
+    "svg", "g", "defs", "symbol", "use", "switch", "view", "title", "desc",
+    "path", "rect", "circle", "ellipse", "line", "polyline", "polygon", "image",
+    "text", "tspan", "textpath",
+    "lineargradient", "radialgradient", "stop", "pattern", "clippath", "mask", "marker",
+    "filter", "feblend", "fecolormatrix", "fecomponenttransfer", "fecomposite",
+    "feconvolvematrix", "fediffuselighting", "fedisplacementmap", "fedistantlight",
+    "fedropshadow", "feflood", "fefunca", "fefuncb", "fefuncg", "fefuncr",
+    "fegaussianblur", "feimage", "femerge", "femergenode", "femorphology", "feoffset",
+    "fepointlight", "fespecularlighting", "fespotlight", "fetile", "feturbulence",
+    "animate", "animatetransform", "animatemotion", "set", "mpath",
+)
+
+// Attributes of the elements above, lowercased. Event handlers and anything
+// unknown are dropped.
+var svgAttributes = setOf(
+    "id", "class", "style", "lang", "version", "baseprofile",
+    "x", "y", "x1", "y1", "x2", "y2", "cx", "cy", "r", "rx", "ry", "fx", "fy", "fr",
+    "width", "height", "d", "points", "pathlength", "viewbox", "preserveaspectratio", "transform",
+    "fill", "fill-opacity", "fill-rule", "stroke", "stroke-width", "stroke-linecap",
+    "stroke-linejoin", "stroke-miterlimit", "stroke-dasharray", "stroke-dashoffset",
+    "stroke-opacity", "opacity", "color", "display", "visibility", "overflow",
+    "clip-path", "clip-rule", "mask", "filter", "marker-start", "marker-mid", "marker-end",
+    "font-family", "font-size", "font-weight", "font-style", "font-variant", "text-anchor",
+    "dominant-baseline", "alignment-baseline", "baseline-shift", "letter-spacing",
+    "word-spacing", "text-decoration", "writing-mode", "textlength", "lengthadjust",
+    "startoffset", "method", "spacing", "stop-color", "stop-opacity", "color-interpolation",
+    "color-interpolation-filters", "flood-color", "flood-opacity", "lighting-color",
+    "shape-rendering", "text-rendering", "image-rendering", "vector-effect", "paint-order",
+    "mix-blend-mode", "isolation",
+    "gradientunits", "gradienttransform", "spreadmethod", "offset", "patternunits",
+    "patterncontentunits", "patterntransform", "clippathunits", "maskunits",
+    "maskcontentunits", "markerunits", "markerwidth", "markerheight", "refx", "refy", "orient",
+    "filterunits", "primitiveunits", "in", "in2", "result", "stddeviation", "dx", "dy",
+    "mode", "type", "values", "operator", "k1", "k2", "k3", "k4", "radius", "scale",
+    "xchannelselector", "ychannelselector", "basefrequency", "numoctaves", "seed",
+    "stitchtiles", "tablevalues", "slope", "intercept", "amplitude", "exponent",
+    "kernelmatrix", "order", "divisor", "bias", "targetx", "targety", "edgemode",
+    "preservealpha", "surfacescale", "specularconstant", "specularexponent",
+    "diffuseconstant", "azimuth", "elevation", "z", "pointsatx", "pointsaty", "pointsatz",
+    "limitingconeangle",
+    "attributename", "attributetype", "begin", "dur", "end", "min", "max", "restart",
+    "repeatcount", "repeatdur", "calcmode", "keytimes", "keysplines", "from", "to", "by",
+    "additive", "accumulate", "path", "keypoints", "rotate",
+    "href",
+)
+
+var svgAnimationElements = setOf("animate", "animatetransform", "animatemotion", "set")
+
+// Unlike xml.EscapeText this keeps line breaks readable.
+var svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+var cssUrl = regexp.MustCompile(`(?i)url\(\s*['"]?([^)'"]*)`)
+
+func setOf(items ...string) map[string]bool {
+    set := map[string]bool{}
+    for _, item := range items {
+        set[item] = true
+    }
+    return set
+}
+
+// Rewrites an SVG document keeping only allowlisted elements and
+// attributes. References may only point at fragments of the document
+// itself or at embedded raster images, so scripts and external resources
+// cannot get in. Comments, processing instructions and doctypes (which
+// could declare entities) are removed as well.
+func sanitizeSvg(body []byte) ([]byte, error) {
+    decoder := xml.NewDecoder(bytes.NewReader(body))
+    var out bytes.Buffer
+    out.WriteString(xml.Header)
+
+    depth, skipDepth := 0, 0
+    for {
+        token, err := decoder.RawToken()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        switch t := token.(type) {
+        case xml.StartElement:
+            depth++
+            if depth == 1 && t.Name.Local != "svg" {
+                return nil, errors.New("root element is not <svg>")
+            }
+            if skipDepth == 0 && !isSafeSvgElement(t) {
+                skipDepth = depth
+            }
+            if skipDepth == 0 {
+                writeSvgStart(&out, t)
+            }
+        case xml.EndElement:
+            if skipDepth == 0 {
+                out.WriteString("</" + svgName(t.Name) + ">")
+            }
+            if skipDepth == depth {
+                skipDepth = 0
+            }
+            depth--
+        case xml.CharData:
+            if depth > 0 && skipDepth == 0 {
+                svgTextEscaper.WriteString(&out, string(t))
+            }
+        }
+    }
+    if depth != 0 {
+        return nil, errors.New("unbalanced elements")
+    }
+    return out.Bytes(), nil
+}
+
+func isSafeSvgElement(element xml.StartElement) bool {
+    name := strings.ToLower(element.Name.Local)
+    if element.Name.Space != "" && element.Name.Space != "svg" || !svgElements[name] {
+        return false
+    }
+    // Animations can set href to anything, bypassing the checks below.
+    if svgAnimationElements[name] {
+        for _, attr := range element.Attr {
+            if strings.ToLower(attr.Name.Local) == "attributename" {
+                target := strings.ToLower(stripUrlSpace(attr.Value))
+                if target == "href" || strings.HasSuffix(target, ":href") {
+                    return false
+                }
+            }
+        }
+    }
+    return true
+}
+
+func writeSvgStart(out *bytes.Buffer, element xml.StartElement) {
+    out.WriteString("<" + svgName(element.Name))
+    for _, attr := range element.Attr {
+        value, ok := safeSvgAttr(attr)
+        if !ok {
+            continue
+        }
+        out.WriteString(" " + svgName(attr.Name) + `="`)
+        xml.EscapeText(out, []byte(value))
+        out.WriteString(`"`)
+    }
+    out.WriteString(">")
+}
+
+// Returns the value to write for attr, or false if it has to go.
+func safeSvgAttr(attr xml.Attr) (string, bool) {
+    name := strings.ToLower(attr.Name.Local)
+    switch strings.ToLower(attr.Name.Space) {
+    case "":
+        if name == "xmlns" {
+            return attr.Value, true
+        }
+    case "xmlns":
+        return attr.Value, true
+    case "xml":
+        return attr.Value, name == "space" || name == "lang"
+    case "xlink":
+        if name != "href" {
+            return "", false
+        }
+    default:
+        return "", false
+    }
+    if !svgAttributes[name] {
+        return "", false
+    }
+
+    if name == "href" {
+        target := stripUrlSpace(attr.Value)
+        return target, isSafeSvgReference(target)
+    }
+    if name == "style" && strings.ContainsAny(attr.Value, `\@`) {
+        // CSS escapes and at-rules could hide anything.
+        return "", false
+    }
+    for _, match := range cssUrl.FindAllStringSubmatch(attr.Value, -1) {
+        if !strings.HasPrefix(stripUrlSpace(match[1]), "#") {
+            return "", false
+        }
+    }
+    return attr.Value, true
+}
+
+func isSafeSvgReference(target string) bool {
+    lower := strings.ToLower(target)
+    if strings.HasPrefix(lower, "#") {
+        return true
+    }
+    for _, format := range []string{"png", "jpeg", "gif", "webp"} {
+        if strings.HasPrefix(lower, "data:image/" + format + ";") || strings.HasPrefix(lower, "data:image/" + format + ",") {
+            return true
+        }
+    }
+    return false
+}
+
+// Browsers drop ASCII whitespace and control characters from URLs, so
+// "java\tscript:" has to be seen as "javascript:".
+func stripUrlSpace(value string) string {
+    return strings.Map(func(r rune) rune {
+        if r <= 0x20 || r == 0x7f {
+            return -1
+        }
+        return r
+    }, value)
+}
+
+// The name as written in the source, RawToken leaves prefixes unresolved.
+func svgName(name xml.Name) string {
+    if name.Space == "" {
+        return name.Local
+    }
+    return name.Space + ":" + name.Local
+}
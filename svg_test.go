@@ -0,0 +1,91 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+const svgOpen = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">`
+
+func TestSanitizeSvgRemoves(t *testing.T) {
+    tests := []struct {
+        name string
+        svg string
+        unwanted string
+    }{
+        {"script", `<script>alert(1)</script>`, "alert"},
+        {"script with namespace prefix", `<svg:script xmlns:svg="http://www.w3.org/2000/svg">alert(1)</svg:script>`, "alert"},
+        {"foreignObject", `<foreignObject><iframe src="https://evil.example"/></foreignObject>`, "evil"},
+        {"unknown element", `<a href="https://evil.example"><rect/></a>`, "evil"},
+        {"event handler", `<rect onclick="alert(1)"/>`, "alert"},
+        {"event handler in uppercase", `<rect ONLOAD="alert(1)"/>`, "alert"},
+        {"javascript href", `<use href="javascript:alert(1)"/>`, "alert"},
+        {"javascript xlink:href", `<use xlink:href="javascript:alert(1)"/>`, "alert"},
+        {"javascript href with tab", `<use href="java&#9;script:alert(1)"/>`, "alert"},
+        {"javascript href with newline and space", `<use href=" java&#10;script:alert(1)"/>`, "alert"},
+        {"external href", `<image href="https://evil.example/a.png"/>`, "evil"},
+        {"svg data href", `<image href="data:image/svg+xml;base64,PHN2Zz4="/>`, "data:"},
+        {"set href", `<set attributeName="href" to="java&#9;script:alert(1)"/>`, "alert"},
+        {"animate xlink:href", `<animate attributeName="xlink:href" values="javascript:alert(1)"/>`, "alert"},
+        {"style element", `<style>@import url(https://evil.example/a.css)</style>`, "evil"},
+        {"external url in style", `<rect style="fill:url(https://evil.example/a.svg#p)"/>`, "evil"},
+        {"css escape in style", `<rect style="fill:u\72l(https://evil.example/a.svg#p)"/>`, "evil"},
+        {"external url in fill", `<rect fill="url( 'https://evil.example/a.svg#p' )"/>`, "evil"},
+        {"external url in filter", `<rect filter="URL(https://evil.example/f.svg#f)"/>`, "evil"},
+        {"comment", `<!-- secret --><rect/>`, "secret"},
+        {"processing instruction", `<?xml-stylesheet href="https://evil.example/a.css"?><rect/>`, "evil"},
+    }
+    for _, test := range tests {
+        out, err := sanitizeSvg([]byte(svgOpen + test.svg + `</svg>`))
+        if err != nil {
+            t.Errorf("%v: unexpected error %v", test.name, err)
+            continue
+        }
+        if strings.Contains(strings.ToLower(string(out)), strings.ToLower(test.unwanted)) {
+            t.Errorf("%v: %q survived in %s", test.name, test.unwanted, out)
+        }
+    }
+}
+
+func TestSanitizeSvgKeeps(t *testing.T) {
+    tests := []struct {
+        name string
+        svg string
+        wanted string
+    }{
+        {"shape", `<rect x="1" y="2" width="3" height="4" fill="#f00"/>`, `<rect x="1" y="2" width="3" height="4" fill="#f00"></rect>`},
+        {"gradient reference", `<rect fill="url(#g)"/>`, `fill="url(#g)"`},
+        {"style without urls", `<rect style="fill:red;stroke-width:2"/>`, `style="fill:red;stroke-width:2"`},
+        {"fragment href", `<use xlink:href="#icon"/>`, `xlink:href="#icon"`},
+        {"raster data href", `<image href="data:image/png;base64,AAAA"/>`, `href="data:image/png;base64,AAAA"`},
+        {"animation of other attributes", `<animate attributeName="opacity" from="0" to="1" dur="1s"/>`, `attributeName="opacity"`},
+        {"escaped text", `<text>a &lt; b</text>`, `<text>a &lt; b</text>`},
+        {"namespace declarations", ``, svgOpen},
+    }
+    for _, test := range tests {
+        out, err := sanitizeSvg([]byte(svgOpen + test.svg + `</svg>`))
+        if err != nil {
+            t.Errorf("%v: unexpected error %v", test.name, err)
+            continue
+        }
+        if !strings.Contains(string(out), test.wanted) {
+            t.Errorf("%v: %q missing in %s", test.name, test.wanted, out)
+        }
+    }
+}
+
+func TestSanitizeSvgRefuses(t *testing.T) {
+    tests := []struct {
+        name string
+        svg string
+    }{
+        {"html root", `<html><svg/></html>`},
+        {"unbalanced", svgOpen + `<g>`},
+        {"not xml", `<svg <<`},
+    }
+    for _, test := range tests {
+        if out, err := sanitizeSvg([]byte(test.svg)); err == nil {
+            t.Errorf("%v: expected an error, got %s", test.name, out)
+        }
+    }
+}
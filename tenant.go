@@ -0,0 +1,209 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "regexp"
+    "sync"
+    "time"
+)
+
+// Header carrying an API key secret, for server to server requests.
+const apiKeyHeader = "X-Api-Key"
+
+// Query parameter naming the API key a URL is signed with. URLs put into
+// pages carry the key id and a signature instead of the secret.
+const apiKeyParam = "key"
+
+// A team sharing the deployment. Its sources are loaded from its own origin
+// and cached under its own prefix, so tenants never see each other's images.
+type Tenant struct {
+    Keys []ApiKey
+    // Base URL like "https://images.example.com", ORIGIN if empty.
+    Origin string
+    // Namespace of the tenant's cache keys, the tenant name if empty.
+    CachePrefix string
+    // Presets the tenant may request. If set, ad-hoc parameters are refused.
+    Presets []string
+    // Requests per minute, unlimited if 0.
+    Quota int
+
+    name string
+    quota tokenBucket
+    quotaLock sync.Mutex
+}
+
+type ApiKey struct {
+    Id string
+    Secret string
+}
+
+type tenantKey struct{}
+
+var cachePrefixPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+
+func (t *Tenant) validate(c *Config) error {
+    if len(t.Keys) == 0 {
+        return errors.New("no keys")
+    }
+    for _, key := range t.Keys {
+        if key.Id == "" || key.Secret == "" {
+            return errors.New("keys need an id and a secret")
+        }
+    }
+    if t.Origin != "" {
+        u, err := url.Parse(t.Origin)
+        if err != nil || u.Scheme == "" || u.Host == "" {
+            return fmt.Errorf("invalid origin %q", t.Origin)
+        }
+    }
+    if !cachePrefixPattern.MatchString(t.CachePrefix) {
+        return fmt.Errorf("invalid cache prefix %q", t.CachePrefix)
+    }
+    if len(t.CachePrefix) > maxNamespaceLength {
+        return fmt.Errorf("cache prefix %q is longer than %v characters", t.CachePrefix, maxNamespaceLength)
+    }
+    for _, preset := range t.Presets {
+        if _, ok := c.Presets[preset]; !ok {
+            return fmt.Errorf("unknown preset %q", preset)
+        }
+    }
+    if t.Quota < 0 {
+        return errors.New("quota must not be negative")
+    }
+    return nil
+}
+
+// Returns how long to wait if the tenant used up its quota.
+func (t *Tenant) takeQuota() time.Duration {
+    t.quotaLock.Lock()
+    defer t.quotaLock.Unlock()
+    return t.quota.take(float64(t.Quota) / 60, float64(t.Quota), time.Now())
+}
+
+// Refuses ad-hoc transformations and presets not meant for the tenant.
+func (t *Tenant) checkPresets(u *url.URL) error {
+    if len(t.Presets) == 0 {
+        return nil
+    }
+    name, adHoc := requestedPreset(u)
+    if adHoc {
+        return errors.New("only presets are allowed")
+    }
+    if name != "" && !contains(t.Presets, name) {
+        return fmt.Errorf("preset %q is not allowed", name)
+    }
+    return nil
+}
+
+func (c *Config) tenantForSecret(secret string) *Tenant {
+    for _, tenant := range c.Tenants {
+        for _, key := range tenant.Keys {
+            if subtle.ConstantTimeCompare([]byte(key.Secret), []byte(secret)) == 1 {
+                return tenant
+            }
+        }
+    }
+    return nil
+}
+
+func (c *Config) tenantForKeyId(id string) (*Tenant, *ApiKey) {
+    for _, tenant := range c.Tenants {
+        for i, key := range tenant.Keys {
+            if key.Id == id {
+                return tenant, &tenant.Keys[i]
+            }
+        }
+    }
+    return nil, nil
+}
+
+func (c *Config) tenantForPrefix(prefix string) *Tenant {
+    for _, tenant := range c.Tenants {
+        if tenant.CachePrefix == prefix {
+            return tenant
+        }
+    }
+    return nil
+}
+
+// The base URL sources in the cache namespace are loaded from.
+func originFor(namespace string) string {
+    if tenant := config.tenantForPrefix(namespace); tenant != nil && tenant.Origin != "" {
+        return tenant.Origin
+    }
+    return originHost()
+}
+
+// The tenant authenticated for r, nil for anonymous requests.
+func tenantFor(r *http.Request) *Tenant {
+    tenant, _ := r.Context().Value(tenantKey{}).(*Tenant)
+    return tenant
+}
+
+// Authenticates the API key of a request, if any, and enforces the
+// tenant's quota. The tenant's cache prefix becomes the host of the request
+// URL, which makes it part of every cache key and selects the origin in
+// loadFromOrigin. Anonymous requests get an empty host, whatever the client
+// sent in the request line.
+func withTenant(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        authFailed, ok := checkAuthRateLimit(w, r)
+        if !ok {
+            return
+        }
+        tenant, err := authenticate(r)
+        if err != nil {
+            authFailed()
+            log.Printf("Refusing %v: %v", r.URL, err)
+            http.Error(w, err.Error(), http.StatusUnauthorized)
+            return
+        }
+        r.URL.Host = ""
+        if tenant == nil {
+            handler(w, r)
+            return
+        }
+        if wait := tenant.takeQuota(); wait > 0 {
+            serveResponse(rateLimitedResponse("tenant " + tenant.name, wait), w)
+            return
+        }
+        r.URL.Host = tenant.CachePrefix
+        handler(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+    }
+}
+
+// Returns the tenant whose key is in the header, or whose key signed the
+// URL. The signature parameters are removed from the URL then.
+func authenticate(r *http.Request) (*Tenant, error) {
+    if secret := r.Header.Get(apiKeyHeader); secret != "" {
+        tenant := config.tenantForSecret(secret)
+        if tenant == nil {
+            return nil, errors.New("unknown API key")
+        }
+        return tenant, nil
+    }
+
+    query := r.URL.Query()
+    id := query.Get(apiKeyParam)
+    if id == "" {
+        if config.RequireApiKey {
+            return nil, errors.New("missing API key")
+        }
+        return nil, nil
+    }
+    tenant, key := config.tenantForKeyId(id)
+    if tenant == nil || !verifySignatureWith(receivedUrl(r), []signingKey{{key.Id, []byte(key.Secret)}}) {
+        return nil, errors.New("unknown API key or invalid signature")
+    }
+    query.Del(apiKeyParam)
+    query.Del(signatureParam)
+    query.Del(expiryParam)
+    r.URL.RawQuery = query.Encode()
+    return tenant, nil
+}
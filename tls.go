@@ -0,0 +1,169 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+var tlsVersions = map[string]uint16{
+    "1.0": tls.VersionTLS10,
+    "1.1": tls.VersionTLS11,
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// Holds the certificate served to new connections. It is replaced when the
+// files change, which leaves established connections alone.
+type certReloader struct {
+    certFile, keyFile string
+    lock sync.RWMutex
+    cert *tls.Certificate
+    modified time.Time
+}
+
+// Serves the registered handlers behind withCanonicalUrl, which has to see
+// requests before the mux cleans their paths on its own.
+func rootHandler() http.Handler {
+    return http.HandlerFunc(withCanonicalUrl(http.DefaultServeMux.ServeHTTP))
+}
+
+// Serves plain HTTP on port, or HTTPS if TLS_CERT_FILE and TLS_KEY_FILE are
+// given. TLS_MIN_VERSION defaults to 1.2, TLS_CIPHER_SUITES takes Go's
+// names of the TLS 1.2 suites to allow (1.3 suites are not configurable).
+// With HTTP_REDIRECT_PORT plain HTTP requests there are redirected to
+// HTTPS.
+func listenAndServe(port string) error {
+    certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+    if certFile == "" && keyFile == "" {
+        log.Printf("Cache listening on port%v", port)
+        return http.ListenAndServe(port, rootHandler())
+    }
+    if certFile == "" || keyFile == "" {
+        return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE have to be given together")
+    }
+
+    reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+    if err := reloader.reload(); err != nil {
+        return err
+    }
+    go reloader.watch()
+
+    tlsConfig, err := tlsSettings()
+    if err != nil {
+        return err
+    }
+    tlsConfig.GetCertificate = reloader.getCertificate
+
+    if redirectPort := os.Getenv("HTTP_REDIRECT_PORT"); redirectPort != "" {
+        go func() {
+            log.Printf("Redirecting HTTP on port:%v to HTTPS", redirectPort)
+            err := http.ListenAndServe(":" + redirectPort, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                redirectToHttps(w, r, port)
+            }))
+            log.Fatalf("Error serving HTTP redirects: %v", err)
+        }()
+    }
+
+    server := &http.Server{Addr: port, Handler: rootHandler(), TLSConfig: tlsConfig}
+    log.Printf("Cache listening with TLS on port%v", port)
+    return server.ListenAndServeTLS("", "")
+}
+
+func tlsSettings() (*tls.Config, error) {
+    config := &tls.Config{MinVersion: tls.VersionTLS12}
+    if name := os.Getenv("TLS_MIN_VERSION"); name != "" {
+        version, ok := tlsVersions[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown TLS_MIN_VERSION %q", name)
+        }
+        config.MinVersion = version
+    }
+
+    names := listSetting("TLS_CIPHER_SUITES")
+    suites := map[string]uint16{}
+    for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+        suites[suite.Name] = suite.ID
+    }
+    for _, name := range names {
+        id, ok := suites[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown cipher suite %q in TLS_CIPHER_SUITES", name)
+        }
+        config.CipherSuites = append(config.CipherSuites, id)
+    }
+    return config, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return c.cert, nil
+}
+
+func (c *certReloader) reload() error {
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        return fmt.Errorf("error loading certificate: %v", err)
+    }
+    c.lock.Lock()
+    c.cert = &cert
+    c.modified = c.lastModified()
+    c.lock.Unlock()
+    log.Printf("Loaded certificate from %v", c.certFile)
+    return nil
+}
+
+func (c *certReloader) lastModified() time.Time {
+    var last time.Time
+    for _, file := range []string{c.certFile, c.keyFile} {
+        if info, err := os.Stat(file); err == nil && info.ModTime().After(last) {
+            last = info.ModTime()
+        }
+    }
+    return last
+}
+
+// Reloads on SIGHUP and when the files changed, checked every ten seconds.
+// A broken certificate is logged and the previous one kept.
+func (c *certReloader) watch() {
+    hangup := make(chan os.Signal, 1)
+    signal.Notify(hangup, syscall.SIGHUP)
+    ticker := time.NewTicker(10 * time.Second)
+    for {
+        select {
+        case <-hangup:
+        case <-ticker.C:
+            c.lock.RLock()
+            unchanged := !c.lastModified().After(c.modified)
+            c.lock.RUnlock()
+            if unchanged {
+                continue
+            }
+        }
+        if err := c.reload(); err != nil {
+            log.Printf("Keeping the previous certificate: %v", err)
+        }
+    }
+}
+
+func redirectToHttps(w http.ResponseWriter, r *http.Request, port string) {
+    host := r.Host
+    if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+        host = hostOnly
+    }
+    if port != ":443" {
+        host = net.JoinHostPort(host, strings.TrimPrefix(port, ":"))
+    }
+    target := "https://" + host + r.URL.RequestURI()
+    http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
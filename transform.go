@@ -0,0 +1,524 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "math"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// A transformation of a source image, built from a preset and/or query
+// parameters. The zero value leaves the source untouched.
+type Transform struct {
+    Width int
+    Height int
+    Quality int
+    Fit string
+    Format string
+    // Name of a configured watermark, set by presets and routes only.
+    Watermark string
+
+    // Filters, see applyFilters for the order they are applied in.
+    Brightness int
+    Contrast int
+    Saturation int
+    Grayscale bool
+    Sepia bool
+    Blur float64
+    Sharpen float64
+
+    // 1-based frame of an animation to extract as a static poster image.
+    Frame int
+
+    // Device pixel ratio, folded into Width and Height by applyClientHints.
+    DPR float64
+
+    // Clockwise rotation in degrees and flip direction (h, v or hv),
+    // applied to the upright source before anything else.
+    Rotate int
+    Flip string
+
+    // Byte budget of the encoded result, reached by lowering JPEG quality.
+    // Only allowed when the output is JPEG, explicitly or because the source
+    // is. There is no WebP encoder, so nothing else can trade quality for
+    // size.
+    MaxBytes int
+
+    // Hex color transparent areas get flattened onto.
+    Background string
+    // Letterbox fit=contain results to exactly Width x Height.
+    Pad bool
+}
+
+const presetPathPrefix = "/_preset/"
+
+// Only JPEG quality can be traded for size.
+const maxBytesFormatError = "maxbytes needs JPEG output, use fm=jpeg"
+
+// Query parameters that describe a transformation instead of being part of
+// the origin URL.
+var transformParams = map[string]bool{
+    "preset": true, "w": true, "h": true, "q": true, "fit": true, "fm": true,
+    "bri": true, "con": true, "sat": true, "gray": true, "sepia": true, "blur": true, "sharpen": true,
+    "frame": true, "dpr": true, "bg": true, "pad": true,
+    "rotate": true, "flip": true, "maxbytes": true,
+}
+
+// Splits a request URL into the requested transformation and the URL of the
+// source image. Presets are selected with /_preset/<name>/<path> or
+// ?preset=<name>; ad-hoc parameters are applied on top of them, route
+// settings below both.
+func parseTransform(u *url.URL) (Transform, *url.URL, error) {
+    var t Transform
+    source := *u
+    query := u.Query()
+
+    presetName := query.Get("preset")
+    if strings.HasPrefix(u.Path, presetPathPrefix) {
+        var ok bool
+        presetName, source.Path, ok = splitPresetPath(u.Path)
+        if !ok {
+            return t, nil, errors.New("missing image path after preset")
+        }
+        source.RawPath = ""
+    }
+    if presetName != "" {
+        preset, ok := config.Presets[presetName]
+        if !ok {
+            return t, nil, fmt.Errorf("unknown preset %q", presetName)
+        }
+        t = preset
+    }
+
+    adHoc, removed := false, false
+    for name := range query {
+        if !transformParams[name] {
+            continue
+        }
+        if name != "preset" && name != "dpr" {
+            adHoc = true
+        }
+        query.Del(name)
+        removed = true
+    }
+    if adHoc && config.PresetsOnly {
+        return t, nil, errors.New("only presets are allowed")
+    }
+    if removed {
+        source.RawQuery = query.Encode()
+    }
+
+    var err error
+    values := u.Query()
+    if t.Width, err = intParam(values, "w", t.Width); err != nil {
+        return t, nil, err
+    }
+    if t.Height, err = intParam(values, "h", t.Height); err != nil {
+        return t, nil, err
+    }
+    if t.Quality, err = intParam(values, "q", t.Quality); err != nil {
+        return t, nil, err
+    }
+    if t.Brightness, err = intParam(values, "bri", t.Brightness); err != nil {
+        return t, nil, err
+    }
+    if t.Contrast, err = intParam(values, "con", t.Contrast); err != nil {
+        return t, nil, err
+    }
+    if t.Saturation, err = intParam(values, "sat", t.Saturation); err != nil {
+        return t, nil, err
+    }
+    if t.Blur, err = floatParam(values, "blur", t.Blur); err != nil {
+        return t, nil, err
+    }
+    if t.Sharpen, err = floatParam(values, "sharpen", t.Sharpen); err != nil {
+        return t, nil, err
+    }
+    if t.DPR, err = floatParam(values, "dpr", t.DPR); err != nil {
+        return t, nil, err
+    }
+    if t.Frame, err = intParam(values, "frame", t.Frame); err != nil {
+        return t, nil, err
+    }
+    if t.MaxBytes, err = intParam(values, "maxbytes", t.MaxBytes); err != nil {
+        return t, nil, err
+    }
+    if t.Rotate, err = intParam(values, "rotate", t.Rotate); err != nil {
+        return t, nil, err
+    }
+    if flip := values.Get("flip"); flip != "" {
+        t.Flip = flip
+    }
+    t.Pad = boolParam(values, "pad", t.Pad)
+    if bg := values.Get("bg"); bg != "" {
+        t.Background = strings.ToLower(strings.TrimPrefix(bg, "#"))
+    }
+    t.Grayscale = boolParam(values, "gray", t.Grayscale)
+    t.Sepia = boolParam(values, "sepia", t.Sepia)
+    if fit := values.Get("fit"); fit != "" {
+        t.Fit = fit
+    }
+    if format := values.Get("fm"); format != "" {
+        t.Format = format
+    }
+    if route := config.routeFor(source.Path); route != nil && t.Watermark == "" {
+        t.Watermark = route.Watermark
+    }
+    return t, &source, t.validate()
+}
+
+// Returns the name of the preset u asks for, if any, and whether it has
+// ad-hoc transform parameters besides it.
+func requestedPreset(u *url.URL) (string, bool) {
+    query := u.Query()
+    name := query.Get("preset")
+    if strings.HasPrefix(u.Path, presetPathPrefix) {
+        name, _, _ = splitPresetPath(u.Path)
+    }
+    for param := range query {
+        if transformParams[param] && param != "preset" && param != "dpr" {
+            return name, true
+        }
+    }
+    return name, false
+}
+
+// Splits /_preset/<name>/<path> into name and path.
+func splitPresetPath(path string) (string, string, bool) {
+    rest := strings.TrimPrefix(path, presetPathPrefix)
+    slash := strings.Index(rest, "/")
+    if slash < 0 {
+        return "", "", false
+    }
+    return rest[:slash], rest[slash:], true
+}
+
+func intParam(values url.Values, name string, fallback int) (int, error) {
+    value := values.Get(name)
+    if value == "" {
+        return fallback, nil
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        return 0, fmt.Errorf("invalid %v=%q", name, value)
+    }
+    return n, nil
+}
+
+func floatParam(values url.Values, name string, fallback float64) (float64, error) {
+    value := values.Get(name)
+    if value == "" {
+        return fallback, nil
+    }
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+        return 0, fmt.Errorf("invalid %v=%q", name, value)
+    }
+    return f, nil
+}
+
+func boolParam(values url.Values, name string, fallback bool) bool {
+    if _, ok := values[name]; !ok {
+        return fallback
+    }
+    value := values.Get(name)
+    return value == "" || value == "1" || value == "true"
+}
+
+const maxDimension = 8192
+
+func (t Transform) validate() error {
+    if t.Width < 0 || t.Height < 0 || t.Width > maxDimension || t.Height > maxDimension {
+        return fmt.Errorf("dimensions must be between 0 and %v", maxDimension)
+    }
+    if t.Quality < 0 || t.Quality > 100 {
+        return errors.New("quality must be between 1 and 100")
+    }
+    for _, adjustment := range []int{t.Brightness, t.Contrast, t.Saturation} {
+        if adjustment < -100 || adjustment > 100 {
+            return errors.New("brightness, contrast and saturation must be between -100 and 100")
+        }
+    }
+    if t.Blur < 0 || t.Blur > 100 {
+        return errors.New("blur must be between 0 and 100")
+    }
+    if t.Sharpen < 0 || t.Sharpen > 10 {
+        return errors.New("sharpen must be between 0 and 10")
+    }
+    if t.Frame < 0 {
+        return errors.New("frame must be positive")
+    }
+    if t.MaxBytes < 0 {
+        return errors.New("maxbytes must be positive")
+    }
+    if t.MaxBytes > 0 && t.Format != "" && t.Format != "jpeg" {
+        return errors.New(maxBytesFormatError)
+    }
+    switch t.Rotate {
+    case 0, 90, 180, 270:
+    default:
+        return errors.New("rotate must be 90, 180 or 270")
+    }
+    switch t.Flip {
+    case "", "h", "v", "hv":
+    default:
+        return errors.New("flip must be h, v or hv")
+    }
+    if t.Background != "" {
+        if _, err := parseHexColor(t.Background); err != nil {
+            return err
+        }
+    }
+    if t.Pad && (t.Fit == "cover" || t.Fit == "fill") {
+        return errors.New("pad only works with fit=contain")
+    }
+    if t.DPR < 0 || t.DPR > maxDPR {
+        return fmt.Errorf("dpr must be between 0 and %v", maxDPR)
+    }
+    switch t.Fit {
+    case "", "contain", "cover", "fill":
+    default:
+        return fmt.Errorf("unknown fit %q", t.Fit)
+    }
+    switch t.Format {
+    case "", "jpeg", "png", "gif":
+    default:
+        return fmt.Errorf("unsupported format %q", t.Format)
+    }
+    return nil
+}
+
+func (t Transform) isEmpty() bool {
+    return t == Transform{}
+}
+
+// Canonical representation used in the variant cache key, so equivalent
+// preset and ad-hoc requests share one cache entry.
+func (t Transform) key() string {
+    var parts []string
+    add := func(name string, value interface{}) {
+        parts = append(parts, fmt.Sprintf("%v=%v", name, value))
+    }
+    if t.Rotate != 0 {
+        add("rotate", t.Rotate)
+    }
+    if t.Flip != "" {
+        add("flip", t.Flip)
+    }
+    if t.Width > 0 {
+        add("w", t.Width)
+    }
+    if t.Height > 0 {
+        add("h", t.Height)
+    }
+    if t.Fit != "" {
+        add("fit", t.Fit)
+    }
+    if t.Quality > 0 {
+        add("q", t.Quality)
+    }
+    if t.Format != "" {
+        add("fm", t.Format)
+    }
+    if t.MaxBytes > 0 {
+        add("maxbytes", t.MaxBytes)
+    }
+    if t.Brightness != 0 {
+        add("bri", t.Brightness)
+    }
+    if t.Contrast != 0 {
+        add("con", t.Contrast)
+    }
+    if t.Saturation != 0 {
+        add("sat", t.Saturation)
+    }
+    if t.Grayscale {
+        add("gray", 1)
+    }
+    if t.Sepia {
+        add("sepia", 1)
+    }
+    if t.Blur > 0 {
+        add("blur", t.Blur)
+    }
+    if t.Sharpen > 0 {
+        add("sharpen", t.Sharpen)
+    }
+    if t.Watermark != "" {
+        add("wm", t.Watermark)
+    }
+    if t.Frame > 0 {
+        add("frame", t.Frame)
+    }
+    if t.Pad {
+        add("pad", 1)
+    }
+    if t.Background != "" {
+        add("bg", t.Background)
+    }
+    return strings.Join(parts, ",")
+}
+
+// Applies t to a (normalized) source image and encodes the result.
+func applyTransform(source ResponseData, t Transform) (ResponseData, error) {
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(source.Body))
+    if err != nil {
+        return source, fmt.Errorf("cannot decode source image: %v", err)
+    }
+    if err := t.checkFilterSize(cfg.Width, cfg.Height); err != nil {
+        return source, err
+    }
+    pipeline, err := newPixelPipeline(t)
+    if err != nil {
+        return source, err
+    }
+    if sniffFormat(source.Body) == "gif" {
+        return applyGifTransform(source, t, pipeline)
+    }
+
+    img, format, err := decodeImage(source.Body)
+    if err != nil {
+        return source, fmt.Errorf("cannot decode source image: %v", err)
+    }
+    if t.Format != "" {
+        format = t.Format
+    }
+    return encodeTransformed(source, pipeline.apply(img), format, t)
+}
+
+func encodeTransformed(source ResponseData, img image.Image, format string, t Transform) (ResponseData, error) {
+    if t.MaxBytes > 0 && format != "jpeg" {
+        return source, errors.New(maxBytesFormatError)
+    }
+    meta := readMetadata(sniffFormat(source.Body), source.Body)
+    encode := func(quality int) ([]byte, error) {
+        body, err := encodeImage(img, format, quality)
+        if err != nil {
+            return nil, err
+        }
+        return embedMetadata(format, body, meta), nil
+    }
+
+    quality := t.Quality
+    if quality == 0 {
+        quality = defaultQuality
+    }
+    var body []byte
+    var err error
+    chosen := 0
+    if t.MaxBytes > 0 {
+        body, chosen, err = encodeWithinBudget(encode, quality, t.MaxBytes)
+    } else {
+        body, err = encode(quality)
+    }
+    if err != nil {
+        return source, fmt.Errorf("cannot encode %v image: %v", format, err)
+    }
+
+    return ResponseData{
+        ContentType: "image/" + format,
+        Body: body,
+        StatusCode: source.StatusCode,
+        Quality: chosen,
+    }, nil
+}
+
+// The per-pixel steps of a transform, with everything they need loaded up
+// front so they can run on many animation frames.
+type pixelPipeline struct {
+    t Transform
+    watermark image.Image
+}
+
+func newPixelPipeline(t Transform) (*pixelPipeline, error) {
+    p := &pixelPipeline{t: t}
+    if t.Watermark != "" {
+        overlay, err := loadWatermark(config.Watermarks[t.Watermark])
+        if err != nil {
+            return nil, fmt.Errorf("cannot load watermark %v: %v", t.Watermark, err)
+        }
+        p.watermark = overlay
+    }
+    return p, nil
+}
+
+func (p *pixelPipeline) apply(img image.Image) image.Image {
+    img = rotateAndFlip(img, p.t.Rotate, p.t.Flip)
+    img = resizeImage(img, p.t)
+    img = applyFilters(img, p.t)
+    if p.t.Pad {
+        img = padImage(img, p.t.Width, p.t.Height)
+    }
+    if p.watermark != nil {
+        img = applyWatermark(img, config.Watermarks[p.t.Watermark], p.watermark)
+    }
+    if p.t.Background != "" {
+        bg, _ := parseHexColor(p.t.Background)
+        img = flattenImage(img, bg)
+    }
+    return img
+}
+
+func resizeImage(img image.Image, t Transform) image.Image {
+    if t.Width == 0 && t.Height == 0 {
+        return img
+    }
+    b := img.Bounds()
+    w, h, crop := resizeTarget(b.Dx(), b.Dy(), t)
+    if !crop.Empty() {
+        img = toNRGBA(img).SubImage(crop)
+    }
+    return resample(img, w, h)
+}
+
+// The size resizeImage scales a srcW x srcH image to, and for fit=cover the
+// centered part of the source it uses.
+func resizeTarget(srcW, srcH int, t Transform) (int, int, image.Rectangle) {
+    if t.Width == 0 && t.Height == 0 {
+        return srcW, srcH, image.Rectangle{}
+    }
+    w, h := t.Width, t.Height
+    var crop image.Rectangle
+    bw, bh := srcW, srcH
+
+    switch {
+    case h == 0:
+        h = atLeastOne(srcH*w/srcW)
+    case w == 0:
+        w = atLeastOne(srcW*h/srcH)
+    case t.Fit == "cover":
+        // Crop the source to the target aspect ratio, centered.
+        cropW, cropH := srcW, srcW*h/w
+        if cropH > srcH {
+            cropW, cropH = srcH*w/h, srcH
+        }
+        x0, y0 := (srcW-cropW)/2, (srcH-cropH)/2
+        crop = image.Rect(x0, y0, x0+cropW, y0+cropH)
+        bw, bh = cropW, cropH
+    case t.Fit != "fill":
+        // contain: the largest size that fits into w x h.
+        if srcW*h > srcH*w {
+            h = atLeastOne(srcH*w/srcW)
+        } else {
+            w = atLeastOne(srcW*h/srcH)
+        }
+    }
+
+    // Never upscale, a larger file would not show any more detail.
+    if w > bw || h > bh {
+        f := math.Min(float64(bw)/float64(w), float64(bh)/float64(h))
+        w, h = atLeastOne(int(float64(w)*f+0.5)), atLeastOne(int(float64(h)*f+0.5))
+    }
+    return w, h, crop
+}
+
+func atLeastOne(n int) int {
+    if n < 1 {
+        return 1
+    }
+    return n
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/gif"
+    "testing"
+)
+
+func TestMaxBytesNeedsJpegOutput(t *testing.T) {
+    img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+    jpegSource, _ := encodeImage(img, "jpeg", defaultQuality)
+    pngSource, _ := encodeImage(img, "png", defaultQuality)
+    var gifSource bytes.Buffer
+    frame := image.NewPaletted(img.Bounds(), []color.Color{color.Black, color.White})
+    gif.EncodeAll(&gifSource, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+
+    tests := []struct {
+        name string
+        source []byte
+        format string
+        ok bool
+    }{
+        {"jpeg source", jpegSource, "", true},
+        {"jpeg output", pngSource, "jpeg", true},
+        {"png source", pngSource, "", false},
+        {"png output", jpegSource, "png", false},
+        {"animated gif", gifSource.Bytes(), "", false},
+        {"gif to jpeg", gifSource.Bytes(), "jpeg", true},
+    }
+    for _, test := range tests {
+        transform := Transform{Width: 32, Format: test.format, MaxBytes: 2000}
+        err := transform.validate()
+        if err == nil {
+            _, err = applyTransform(ResponseData{Body: test.source, StatusCode: 200}, transform)
+        }
+        if (err == nil) != test.ok {
+            t.Errorf("%v: maxbytes gave %v, want ok=%v", test.name, err, test.ok)
+        }
+    }
+}
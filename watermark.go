@@ -0,0 +1,102 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+)
+
+// An overlay composited onto transformed images. The image itself is
+// loaded from the origin and cached like any other source.
+type Watermark struct {
+    Path string
+    // One of top-left, top, top-right, left, center, right, bottom-left,
+    // bottom or bottom-right (default).
+    Position string
+    // Distance in pixels from the edges named by Position.
+    Margin int
+    // From 0 to 1, where 1 is fully opaque. Unset or 0 also means fully
+    // opaque, an invisible watermark would be pointless.
+    Opacity float64
+    // Width of the overlay relative to the output width, 0 keeps its size.
+    Scale float64
+}
+
+func (wm Watermark) validate() error {
+    if wm.Path == "" {
+        return errors.New("missing path")
+    }
+    if wm.Opacity < 0 || wm.Opacity > 1 {
+        return errors.New("opacity must be between 0 and 1")
+    }
+    if wm.Scale < 0 || wm.Scale > 1 {
+        return errors.New("scale must be between 0 and 1")
+    }
+    switch wm.Position {
+    case "", "top-left", "top", "top-right", "left", "center", "right", "bottom-left", "bottom", "bottom-right":
+        return nil
+    }
+    return fmt.Errorf("unknown position %q", wm.Position)
+}
+
+func loadWatermark(wm Watermark) (image.Image, error) {
+    u, err := canonicalUrl(wm.Path)
+    if err != nil {
+        return nil, err
+    }
+    source, _ := loadSource(u, nil)
+    if source.StatusCode != 200 {
+        return nil, fmt.Errorf("origin returned %v for %v", source.StatusCode, wm.Path)
+    }
+    img, _, err := decodeImage(source.Body)
+    return img, err
+}
+
+// Composites overlay, as loaded by loadWatermark, onto img.
+func applyWatermark(img image.Image, wm Watermark, overlay image.Image) image.Image {
+    dst := toNRGBA(img)
+    b := dst.Bounds()
+    if wm.Scale > 0 {
+        ob := overlay.Bounds()
+        w := atLeastOne(int(float64(b.Dx()) * wm.Scale))
+        overlay = resample(overlay, w, atLeastOne(ob.Dy()*w/ob.Dx()))
+    }
+
+    opacity := wm.Opacity
+    if opacity == 0 {
+        opacity = 1
+    }
+    mask := image.NewUniform(color.Alpha{uint8(opacity * 255)})
+    ob := overlay.Bounds()
+    at := watermarkPosition(wm, b.Size(), ob.Size())
+    draw.DrawMask(dst, ob.Sub(ob.Min).Add(at), overlay, ob.Min, mask, image.Point{}, draw.Over)
+    return dst
+}
+
+func watermarkPosition(wm Watermark, canvas, size image.Point) image.Point {
+    left, right := wm.Margin, canvas.X-size.X-wm.Margin
+    top, bottom := wm.Margin, canvas.Y-size.Y-wm.Margin
+    centerX, centerY := (canvas.X-size.X)/2, (canvas.Y-size.Y)/2
+
+    switch wm.Position {
+    case "top-left":
+        return image.Pt(left, top)
+    case "top":
+        return image.Pt(centerX, top)
+    case "top-right":
+        return image.Pt(right, top)
+    case "left":
+        return image.Pt(left, centerY)
+    case "center":
+        return image.Pt(centerX, centerY)
+    case "right":
+        return image.Pt(right, centerY)
+    case "bottom-left":
+        return image.Pt(left, bottom)
+    case "bottom":
+        return image.Pt(centerX, bottom)
+    }
+    return image.Pt(right, bottom)
+}